@@ -3,7 +3,11 @@ CREATE TABLE IF NOT EXISTS users (
     nickname    VARCHAR(128) NOT NULL,
     login_name  VARCHAR(128) NOT NULL,
     pass_hash   VARCHAR(128) NOT NULL,
-    UNIQUE KEY login_name_uniq (login_name)
+    email       VARCHAR(255) DEFAULT NULL,
+    session_version INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    deleted_at  DATETIME(6)  DEFAULT NULL,
+    UNIQUE KEY login_name_uniq (login_name),
+    UNIQUE KEY email_uniq (email)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS events (
@@ -11,7 +15,123 @@ CREATE TABLE IF NOT EXISTS events (
     title       VARCHAR(128)     NOT NULL,
     public_fg   TINYINT(1)       NOT NULL,
     closed_fg   TINYINT(1)       NOT NULL,
-    price       INTEGER UNSIGNED NOT NULL
+    price       INTEGER UNSIGNED NOT NULL,
+    start_at    DATETIME         DEFAULT NULL,
+    category_id INTEGER UNSIGNED DEFAULT NULL,
+    organizer   VARCHAR(128)     NOT NULL DEFAULT '',
+    description TEXT             DEFAULT NULL,
+    KEY start_at_idx (start_at),
+    KEY category_id_idx (category_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS categories (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    slug        VARCHAR(32)      NOT NULL,
+    name        VARCHAR(64)      NOT NULL,
+    UNIQUE KEY slug_uniq (slug)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_tags (
+    event_id    INTEGER UNSIGNED NOT NULL,
+    tag         VARCHAR(32)      NOT NULL,
+    PRIMARY KEY (event_id, tag),
+    KEY tag_idx (tag)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_performers (
+    event_id    INTEGER UNSIGNED NOT NULL,
+    position    INTEGER UNSIGNED NOT NULL,
+    name        VARCHAR(128)     NOT NULL,
+    role        VARCHAR(64)      NOT NULL DEFAULT '',
+    PRIMARY KEY (event_id, position)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_images (
+    event_id      INTEGER UNSIGNED NOT NULL,
+    position      INTEGER UNSIGNED NOT NULL,
+    image_id      INTEGER UNSIGNED DEFAULT NULL,
+    url           VARCHAR(512)     NOT NULL,
+    thumbnail_url VARCHAR(512)     NOT NULL DEFAULT '',
+    alt           VARCHAR(128)     NOT NULL DEFAULT '',
+    PRIMARY KEY (event_id, position)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_purchase_limits (
+    event_id     INTEGER UNSIGNED NOT NULL,
+    sheet_rank   VARCHAR(128)     NOT NULL,
+    max_per_user INTEGER UNSIGNED NOT NULL,
+    PRIMARY KEY (event_id, sheet_rank)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_queues (
+    event_id          INTEGER UNSIGNED PRIMARY KEY,
+    enabled_fg        TINYINT(1)       NOT NULL,
+    paused_fg         TINYINT(1)       NOT NULL,
+    admit_rate        INTEGER UNSIGNED NOT NULL,
+    admission_ttl     INTEGER UNSIGNED NOT NULL,
+    admit_budget      DOUBLE           NOT NULL,
+    budget_updated_at DATETIME(6)      NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS queue_tickets (
+    id          BIGINT UNSIGNED  PRIMARY KEY AUTO_INCREMENT,
+    event_id    INTEGER UNSIGNED NOT NULL,
+    user_id     INTEGER UNSIGNED NOT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    admitted_at DATETIME(6)      DEFAULT NULL,
+    expires_at  DATETIME(6)      DEFAULT NULL,
+    UNIQUE KEY event_id_user_id_uniq (event_id, user_id),
+    KEY event_id_admitted_at_idx (event_id, admitted_at, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_lotteries (
+    event_id        INTEGER UNSIGNED PRIMARY KEY,
+    entry_starts_at DATETIME(6)      NOT NULL,
+    entry_ends_at   DATETIME(6)      NOT NULL,
+    max_quantity    INTEGER UNSIGNED NOT NULL,
+    status          VARCHAR(16)      NOT NULL,
+    seed            BIGINT           DEFAULT NULL,
+    algorithm       VARCHAR(255)     NOT NULL,
+    drawn_at        DATETIME(6)      DEFAULT NULL,
+    published_at    DATETIME(6)      DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS lottery_entries (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id    INTEGER UNSIGNED NOT NULL,
+    user_id     INTEGER UNSIGNED NOT NULL,
+    sheet_rank  VARCHAR(128)     NOT NULL,
+    quantity    INTEGER UNSIGNED NOT NULL,
+    result      VARCHAR(16)      DEFAULT NULL,
+    draw_order  INTEGER UNSIGNED DEFAULT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    canceled_at DATETIME(6)      DEFAULT NULL,
+    UNIQUE KEY event_id_user_id_uniq (event_id, user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS lottery_assignments (
+    event_id    INTEGER UNSIGNED NOT NULL,
+    entry_id    INTEGER UNSIGNED NOT NULL,
+    sheet_id    INTEGER UNSIGNED NOT NULL,
+    PRIMARY KEY (event_id, sheet_id),
+    KEY entry_id_idx (entry_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    bucket_key  VARCHAR(255)     NOT NULL PRIMARY KEY,
+    tokens      DOUBLE           NOT NULL,
+    updated_at  DATETIME(6)      NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS images (
+    id               INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    hash             CHAR(64)         NOT NULL,
+    format           VARCHAR(8)       NOT NULL,
+    width            INTEGER UNSIGNED NOT NULL,
+    height           INTEGER UNSIGNED NOT NULL,
+    administrator_id INTEGER UNSIGNED NOT NULL,
+    created_at       DATETIME(6)      NOT NULL,
+    UNIQUE KEY hash_uniq (hash)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS sheets (
@@ -41,5 +161,230 @@ CREATE TABLE IF NOT EXISTS administrators (
     nickname    VARCHAR(128) NOT NULL,
     login_name  VARCHAR(128) NOT NULL,
     pass_hash   VARCHAR(128) NOT NULL,
+    role        VARCHAR(32)  NOT NULL DEFAULT 'admin',
+    active_fg   TINYINT(1)   NOT NULL DEFAULT 1,
+    totp_secret      VARCHAR(64) NOT NULL DEFAULT '',
+    totp_enabled_fg  TINYINT(1)  NOT NULL DEFAULT 0,
+    totp_required_fg TINYINT(1)  NOT NULL DEFAULT 0,
+    totp_last_step   BIGINT      NOT NULL DEFAULT 0,
+    session_version  INTEGER UNSIGNED NOT NULL DEFAULT 0,
     UNIQUE KEY login_name_uniq (login_name)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id           BIGINT UNSIGNED  PRIMARY KEY AUTO_INCREMENT,
+    actor_type   VARCHAR(16)      NOT NULL,
+    actor_id     INTEGER UNSIGNED NOT NULL,
+    action       VARCHAR(64)      NOT NULL,
+    target_type  VARCHAR(32)      NOT NULL,
+    target_id    INTEGER UNSIGNED NOT NULL,
+    before_value TEXT             DEFAULT NULL,
+    after_value  TEXT             DEFAULT NULL,
+    request_id   VARCHAR(64)      NOT NULL,
+    client_ip    VARCHAR(64)      NOT NULL,
+    created_at   DATETIME(6)      NOT NULL,
+    KEY actor_idx (actor_type, actor_id),
+    KEY target_idx (target_type, target_id),
+    KEY action_idx (action),
+    KEY created_at_idx (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS administrator_recovery_codes (
+    id               INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    administrator_id INTEGER UNSIGNED NOT NULL,
+    code_hash        VARCHAR(128)     NOT NULL,
+    used_at          DATETIME(6)      DEFAULT NULL,
+    KEY administrator_id_idx (administrator_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS login_failures (
+    scope          VARCHAR(16)  NOT NULL,
+    key_type       VARCHAR(16)  NOT NULL,
+    key_value      VARCHAR(128) NOT NULL,
+    failures       INTEGER      NOT NULL,
+    last_failed_at DATETIME(6)  NOT NULL,
+    locked_until   DATETIME(6)  DEFAULT NULL,
+    PRIMARY KEY (scope, key_type, key_value),
+    KEY locked_until_idx (locked_until)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    user_id     INTEGER UNSIGNED NOT NULL,
+    token_hash  VARCHAR(128)     NOT NULL,
+    expires_at  DATETIME(6)      NOT NULL,
+    used_at     DATETIME(6)      DEFAULT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    UNIQUE KEY token_hash_uniq (token_hash),
+    KEY user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_sale_phases (
+    id               INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id         INTEGER UNSIGNED NOT NULL,
+    name             VARCHAR(64)      NOT NULL,
+    starts_at        DATETIME(6)      NOT NULL,
+    ends_at          DATETIME(6)      DEFAULT NULL,
+    access           VARCHAR(16)      NOT NULL,
+    group_name       VARCHAR(64)      NOT NULL DEFAULT '',
+    access_code_hash VARCHAR(64)      NOT NULL DEFAULT '',
+    KEY event_id_idx (event_id, starts_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS sale_phase_members (
+    phase_id    INTEGER UNSIGNED NOT NULL,
+    user_id     INTEGER UNSIGNED NOT NULL,
+    source      VARCHAR(16)      NOT NULL,
+    PRIMARY KEY (phase_id, user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS user_groups (
+    user_id     INTEGER UNSIGNED NOT NULL,
+    group_name  VARCHAR(64)      NOT NULL,
+    PRIMARY KEY (user_id, group_name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS notification_outbox (
+    id              INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    user_id         INTEGER UNSIGNED NOT NULL,
+    kind            VARCHAR(32)      NOT NULL,
+    channel         VARCHAR(16)      NOT NULL,
+    subject         VARCHAR(255)     NOT NULL,
+    body            TEXT             NOT NULL,
+    status          VARCHAR(16)      NOT NULL,
+    attempts        INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    last_error      VARCHAR(255)     NOT NULL DEFAULT '',
+    next_attempt_at DATETIME(6)      NOT NULL,
+    created_at      DATETIME(6)      NOT NULL,
+    sent_at         DATETIME(6)      DEFAULT NULL,
+    KEY status_next_idx (status, next_attempt_at),
+    KEY user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id     INTEGER UNSIGNED NOT NULL,
+    kind        VARCHAR(32)      NOT NULL,
+    channel     VARCHAR(16)      NOT NULL,
+    enabled     TINYINT(1)       NOT NULL,
+    PRIMARY KEY (user_id, kind, channel)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS notification_reminders (
+    event_id    INTEGER UNSIGNED NOT NULL,
+    user_id     INTEGER UNSIGNED NOT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    PRIMARY KEY (event_id, user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    url         VARCHAR(512)     NOT NULL,
+    secret      VARCHAR(128)     NOT NULL,
+    events      VARCHAR(255)     NOT NULL,
+    active      TINYINT(1)       NOT NULL,
+    created_at  DATETIME(6)      NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id               INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    subscription_id  INTEGER UNSIGNED NOT NULL,
+    event_id         VARCHAR(32)      NOT NULL,
+    event_type       VARCHAR(32)      NOT NULL,
+    payload          MEDIUMBLOB       NOT NULL,
+    status           VARCHAR(16)      NOT NULL,
+    attempts         INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    last_status_code INTEGER          NOT NULL DEFAULT 0,
+    last_error       VARCHAR(255)     NOT NULL DEFAULT '',
+    redelivery_of    INTEGER UNSIGNED DEFAULT NULL,
+    next_attempt_at  DATETIME(6)      NOT NULL,
+    created_at       DATETIME(6)      NOT NULL,
+    delivered_at     DATETIME(6)      DEFAULT NULL,
+    KEY status_next_idx (status, next_attempt_at),
+    KEY subscription_id_idx (subscription_id, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS checkins (
+    reservation_id   INTEGER UNSIGNED PRIMARY KEY,
+    event_id         INTEGER UNSIGNED NOT NULL,
+    gate             VARCHAR(32)      NOT NULL,
+    source           VARCHAR(16)      NOT NULL,
+    administrator_id INTEGER UNSIGNED NOT NULL,
+    checked_in_at    DATETIME(6)      NOT NULL,
+    created_at       DATETIME(6)      NOT NULL,
+    KEY event_id_idx (event_id, gate)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS ticket_transfers (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    event_id       INTEGER UNSIGNED NOT NULL,
+    from_user_id   INTEGER UNSIGNED NOT NULL,
+    to_user_id     INTEGER UNSIGNED NOT NULL,
+    status         VARCHAR(16)      NOT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    expires_at     DATETIME(6)      NOT NULL,
+    responded_at   DATETIME(6)      DEFAULT NULL,
+    KEY reservation_id_idx (reservation_id, status),
+    KEY from_user_id_idx (from_user_id, id),
+    KEY to_user_id_idx (to_user_id, id),
+    KEY event_id_idx (event_id, status)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_transfer_policies (
+    event_id INTEGER UNSIGNED PRIMARY KEY,
+    enabled  TINYINT(1)       NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_resale_policies (
+    event_id          INTEGER UNSIGNED PRIMARY KEY,
+    enabled           TINYINT(1)       NOT NULL,
+    max_price_percent INTEGER UNSIGNED NOT NULL,
+    fee_percent       INTEGER UNSIGNED NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS resale_listings (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    event_id       INTEGER UNSIGNED NOT NULL,
+    sheet_id       INTEGER UNSIGNED NOT NULL,
+    seller_user_id INTEGER UNSIGNED NOT NULL,
+    price          INTEGER UNSIGNED NOT NULL,
+    face_price     INTEGER UNSIGNED NOT NULL,
+    status         VARCHAR(16)      NOT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    closed_at      DATETIME(6)      DEFAULT NULL,
+    KEY reservation_id_idx (reservation_id, status),
+    KEY event_id_idx (event_id, status, price),
+    KEY seller_user_id_idx (seller_user_id, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS resale_sales (
+    id                      INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    listing_id              INTEGER UNSIGNED NOT NULL,
+    event_id                INTEGER UNSIGNED NOT NULL,
+    original_reservation_id INTEGER UNSIGNED NOT NULL,
+    reservation_id          INTEGER UNSIGNED NOT NULL,
+    seller_user_id          INTEGER UNSIGNED NOT NULL,
+    buyer_user_id           INTEGER UNSIGNED NOT NULL,
+    price                   INTEGER UNSIGNED NOT NULL,
+    fee                     INTEGER UNSIGNED NOT NULL,
+    seller_proceeds         INTEGER UNSIGNED NOT NULL,
+    sold_at                 DATETIME(6)      NOT NULL,
+    UNIQUE KEY listing_id_uniq (listing_id),
+    KEY event_id_idx (event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS seat_changes (
+    id                      INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id                INTEGER UNSIGNED NOT NULL,
+    user_id                 INTEGER UNSIGNED NOT NULL,
+    original_reservation_id INTEGER UNSIGNED NOT NULL,
+    reservation_id          INTEGER UNSIGNED NOT NULL,
+    previous_price          INTEGER UNSIGNED NOT NULL,
+    price                   INTEGER UNSIGNED NOT NULL,
+    price_difference        INTEGER          NOT NULL,
+    changed_at              DATETIME(6)      NOT NULL,
+    UNIQUE KEY reservation_id_uniq (reservation_id),
+    KEY event_id_idx (event_id),
+    KEY user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -13,6 +13,13 @@ type Administrator struct {
 	Nickname  string `json:"nickname,omitempty"`
 	LoginName string `json:"login_name,omitempty"`
 	PassHash  string `json:"pass_hash,omitempty"`
+	Role      string `json:"role,omitempty"`
+	ActiveFg  bool   `json:"active"`
+
+	TOTPEnabled  bool `json:"totp_enabled"`
+	TOTPRequired bool `json:"totp_required"`
+
+	SessionVersion int64 `json:"-"`
 }
 
 func sessAdministratorID(c echo.Context) int64 {
@@ -24,7 +31,9 @@ func sessAdministratorID(c echo.Context) int64 {
 	return administratorID
 }
 
-func sessSetAdministratorID(c echo.Context, id int64) {
+// sessSetAdministratorID also remembers the session version, so that bumping
+// administrators.session_version revokes every session issued before.
+func sessSetAdministratorID(c echo.Context, id, sessionVersion int64) {
 	sess, _ := session.Get("session", c)
 	sess.Options = &sessions.Options{
 		Path:     "/",
@@ -32,9 +41,19 @@ func sessSetAdministratorID(c echo.Context, id int64) {
 		HttpOnly: true,
 	}
 	sess.Values["administrator_id"] = id
+	sess.Values["administrator_session_version"] = sessionVersion
 	sess.Save(c.Request(), c.Response())
 }
 
+func sessAdministratorSessionVersion(c echo.Context) int64 {
+	sess, _ := session.Get("session", c)
+	var sessionVersion int64
+	if x, ok := sess.Values["administrator_session_version"]; ok {
+		sessionVersion, _ = x.(int64)
+	}
+	return sessionVersion
+}
+
 func sessDeleteAdministratorID(c echo.Context) {
 	sess, _ := session.Get("session", c)
 	sess.Options = &sessions.Options{
@@ -43,13 +62,51 @@ func sessDeleteAdministratorID(c echo.Context) {
 		HttpOnly: true,
 	}
 	delete(sess.Values, "administrator_id")
+	delete(sess.Values, "administrator_session_version")
 	sess.Save(c.Request(), c.Response())
 }
 
+// authorizeAdministrator returns the logged in administrator if they may use
+// the admin pages: an administrator required to use TOTP must have enrolled.
+func authorizeAdministrator(c echo.Context) (*Administrator, error) {
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return nil, unauthorizedError("admin_login_required")
+	}
+	if administrator.TOTPRequired && !administrator.TOTPEnabled {
+		return nil, forbiddenError("totp_enrollment_required")
+	}
+	return administrator, nil
+}
+
 func adminLoginRequired(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, err := authorizeAdministrator(c); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
+
+// adminSessionRequired only checks the session, so that administrators who
+// still have to enroll TOTP can reach the enrollment endpoints.
+func adminSessionRequired(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		if _, err := getLoginAdministrator(c); err != nil {
-			return resError(c, "admin_login_required", 401)
+			return unauthorizedError("admin_login_required")
+		}
+		return next(c)
+	}
+}
+
+func superadminRequired(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		administrator, err := authorizeAdministrator(c)
+		if err != nil {
+			return err
+		}
+		if administrator.Role != roleSuperadmin {
+			return forbiddenError("forbidden")
 		}
 		return next(c)
 	}
@@ -61,13 +118,21 @@ func getLoginAdministrator(c echo.Context) (*Administrator, error) {
 		return nil, errors.New("not logged in")
 	}
 	var administrator Administrator
-	err := db.QueryRow("SELECT id, nickname FROM administrators WHERE id = ?", administratorID).Scan(&administrator.ID, &administrator.Nickname)
-	return &administrator, err
+	err := db.QueryRow("SELECT id, login_name, nickname, role, active_fg, totp_enabled_fg, totp_required_fg, session_version FROM administrators WHERE id = ? AND active_fg = 1", administratorID).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.Role, &administrator.ActiveFg, &administrator.TOTPEnabled, &administrator.TOTPRequired, &administrator.SessionVersion)
+	if err != nil {
+		return nil, err
+	}
+	if administrator.SessionVersion != sessAdministratorSessionVersion(c) {
+		return nil, errors.New("session revoked")
+	}
+	return &administrator, nil
 }
 
+// fillinAdministrator sets the administrator for pages that also render for
+// visitors. It applies the same checks as adminLoginRequired.
 func fillinAdministrator(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		if administrator, err := getLoginAdministrator(c); err == nil {
+		if administrator, err := authorizeAdministrator(c); err == nil {
 			c.Set("administrator", administrator)
 		}
 		return next(c)
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	roleSuperadmin = "superadmin"
+	roleAdmin      = "admin"
+)
+
+var (
+	errAdministratorNotFound = notFoundError("not_found")
+	errDuplicatedLoginName   = conflictError("duplicated")
+	errInvalidRole           = validationError("invalid_role")
+	errLastSuperadmin        = conflictError("last_superadmin")
+)
+
+func validateRole(role string) bool {
+	switch role {
+	case roleSuperadmin, roleAdmin:
+		return true
+	}
+	return false
+}
+
+func getAdministrators() ([]*Administrator, error) {
+	rows, err := db.Query("SELECT id, login_name, nickname, role, active_fg, totp_enabled_fg, totp_required_fg FROM administrators ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	administrators := make([]*Administrator, 0)
+	for rows.Next() {
+		var administrator Administrator
+		if err := rows.Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.Role, &administrator.ActiveFg, &administrator.TOTPEnabled, &administrator.TOTPRequired); err != nil {
+			return nil, err
+		}
+		administrators = append(administrators, &administrator)
+	}
+	return administrators, rows.Err()
+}
+
+func getAdministrator(id int64) (*Administrator, error) {
+	return loadAdministrator(db, id)
+}
+
+func loadAdministrator(q queryRower, id int64) (*Administrator, error) {
+	var administrator Administrator
+	if err := q.QueryRow("SELECT id, login_name, nickname, role, active_fg, totp_enabled_fg, totp_required_fg FROM administrators WHERE id = ?", id).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.Role, &administrator.ActiveFg, &administrator.TOTPEnabled, &administrator.TOTPRequired); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errAdministratorNotFound
+		}
+		return nil, err
+	}
+	return &administrator, nil
+}
+
+// administratorParams are the fields of a new administrator, with the rules
+// both the API and `torb admin create` have to pass.
+type administratorParams struct {
+	LoginName string `json:"login_name" validate:"required,max=128,charset=loginname"`
+	Nickname  string `json:"nickname" validate:"required,max=128,charset=printable"`
+	Password  string `json:"password" validate:"required,min=8,max=128"`
+	Role      string `json:"role" validate:"oneof=superadmin|admin"`
+}
+
+// createAdministrator validates the fields, adds an administrator and writes
+// the audit log in the same transaction. c is nil when called from the
+// command line.
+func createAdministrator(c echo.Context, loginName, nickname, password, role string) (*Administrator, error) {
+	if err := (structValidator{}).Validate(&administratorParams{LoginName: loginName, Nickname: nickname, Password: password, Role: role}); err != nil {
+		return nil, err
+	}
+	if !validateRole(role) {
+		return nil, errInvalidRole
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM administrators WHERE login_name = ?", loginName).Scan(&id); err != sql.ErrNoRows {
+		tx.Rollback()
+		if err == nil {
+			return nil, errDuplicatedLoginName
+		}
+		return nil, err
+	}
+
+	res, err := tx.Exec("INSERT INTO administrators (login_name, pass_hash, nickname, role, active_fg) VALUES (?, SHA2(?, 256), ?, ?, 1)", loginName, password, nickname, role)
+	if err != nil {
+		tx.Rollback()
+		// 同時に作られた場合は一意キーで弾かれる
+		if isDuplicateKeyError(err) {
+			return nil, errDuplicatedLoginName
+		}
+		return nil, err
+	}
+	id, err = res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	administrator, err := loadAdministrator(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := writeAuditLog(tx, c, "administrator.create", "administrator", id, nil, administrator); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return administrator, nil
+}
+
+// updateAdministrator changes the nickname and/or password. Empty values are left
+// untouched. Changing the password revokes every session of the administrator.
+func updateAdministrator(c echo.Context, id int64, nickname, password string) (*Administrator, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var current string
+	if err := tx.QueryRow("SELECT nickname FROM administrators WHERE id = ? FOR UPDATE", id).Scan(&current); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, errAdministratorNotFound
+		}
+		return nil, err
+	}
+	if nickname != "" {
+		if _, err := tx.Exec("UPDATE administrators SET nickname = ? WHERE id = ?", nickname, id); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if password != "" {
+		if _, err := tx.Exec("UPDATE administrators SET pass_hash = SHA2(?, 256), session_version = session_version + 1 WHERE id = ?", password, id); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	administrator, err := loadAdministrator(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	after := echo.Map{"nickname": administrator.Nickname, "password_changed": password != ""}
+	if err := writeAuditLog(tx, c, "administrator.edit", "administrator", id, echo.Map{"nickname": current}, after); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.QueryRow("SELECT session_version FROM administrators WHERE id = ?", id).Scan(&administrator.SessionVersion); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return administrator, nil
+}
+
+// changeAdministrator updates role and active flag of an administrator while
+// making sure at least one active superadmin remains. The change is audited as
+// action in the same transaction.
+func changeAdministrator(c echo.Context, action string, id int64, role string, active bool) (*Administrator, error) {
+	if !validateRole(role) {
+		return nil, errInvalidRole
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// 最後のsuperadminを外さないよう、superadmin行をロックして数える
+	rows, err := tx.Query("SELECT id FROM administrators WHERE role = ? AND active_fg = 1 FOR UPDATE", roleSuperadmin)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var superadminIDs []int64
+	for rows.Next() {
+		var superadminID int64
+		if err := rows.Scan(&superadminID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		superadminIDs = append(superadminIDs, superadminID)
+	}
+	rows.Close()
+
+	if contains(superadminIDs, id) && len(superadminIDs) <= 1 && (role != roleSuperadmin || !active) {
+		tx.Rollback()
+		return nil, errLastSuperadmin
+	}
+
+	var locked int64
+	if err := tx.QueryRow("SELECT id FROM administrators WHERE id = ? FOR UPDATE", id).Scan(&locked); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, errAdministratorNotFound
+		}
+		return nil, err
+	}
+	current, err := loadAdministrator(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE administrators SET role = ?, active_fg = ? WHERE id = ?", role, active, id); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	administrator, err := loadAdministrator(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := writeAuditLog(tx, c, action, "administrator", id, current, administrator); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return administrator, nil
+}
+
+func getAdministratorsHandler(c echo.Context) error {
+	administrators, err := getAdministrators()
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, administrators)
+}
+
+func postAdministratorsHandler(c echo.Context) error {
+	var params administratorParams
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	if params.Role == "" {
+		params.Role = roleAdmin
+	}
+
+	administrator, err := createAdministrator(c, params.LoginName, params.Nickname, params.Password, params.Role)
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, administrator)
+}
+
+func editAdministratorHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+
+	loginAdministrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+	if loginAdministrator.ID != id && loginAdministrator.Role != roleSuperadmin {
+		return forbiddenError("forbidden")
+	}
+
+	var params struct {
+		Nickname string `json:"nickname" validate:"max=128,charset=printable"`
+		Password string `json:"password" validate:"min=8,max=128"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	administrator, err := updateAdministrator(c, id, params.Nickname, params.Password)
+	if err != nil {
+		return err
+	}
+	// 自分のパスワードを変えたときはこのセッションだけ残す
+	if id == loginAdministrator.ID && params.Password != "" {
+		sessSetAdministratorID(c, id, administrator.SessionVersion)
+	}
+	return c.JSON(200, administrator)
+}
+
+func changeAdministratorRoleHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+
+	var params struct {
+		Role string `json:"role" validate:"required,oneof=superadmin|admin"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	current, err := getAdministrator(id)
+	if err != nil {
+		return err
+	}
+	administrator, err := changeAdministrator(c, "administrator.role", id, params.Role, current.ActiveFg)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, administrator)
+}
+
+func setAdministratorActiveHandler(active bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return notFoundError("not_found")
+		}
+
+		current, err := getAdministrator(id)
+		if err != nil {
+			return err
+		}
+		action := "administrator.deactivate"
+		if active {
+			action = "administrator.activate"
+		}
+		administrator, err := changeAdministrator(c, action, id, current.Role, active)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, administrator)
+	}
+}
@@ -26,7 +26,7 @@ import (
 func loginRequired(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		if _, err := getLoginUser(c); err != nil {
-			return resError(c, "login_required", 401)
+			return unauthorizedError("login_required")
 		}
 		return next(c)
 	}
@@ -54,32 +54,81 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if n, err := strconv.Atoi(os.Getenv("DB_MAX_OPEN_CONNS")); err == nil && n > 0 {
+		db.SetMaxOpenConns(n)
+	}
+	notificationChannels = newNotificationChannels(os.Getenv)
+	initSigningKey(os.Getenv("SIGNING_KEY"))
+	imageStorage = newImageStorage(os.Getenv("IMAGE_STORAGE"))
+	if trustedProxies, err = loadTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// NOTIFY_WORKER_INTERVAL / WEBHOOK_WORKER_INTERVAL=off leaves delivery to other instances
+	if interval, ok := workerInterval(os.Getenv("NOTIFY_WORKER_INTERVAL")); ok {
+		go runNotificationWorker(interval)
+	}
+	if interval, ok := workerInterval(os.Getenv("WEBHOOK_WORKER_INTERVAL")); ok {
+		go runWebhookWorker(interval)
+	}
 
 	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler
 	funcs := template.FuncMap{
 		"encode_json": func(v interface{}) string {
 			b, _ := json.Marshal(v)
 			return string(b)
 		},
 	}
+	e.Validator = structValidator{}
 	e.Renderer = &Renderer{
 		templates: template.Must(template.New("").Delims("[[", "]]").Funcs(funcs).ParseGlob("views/*.tmpl")),
 	}
 	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	e.Use(middleware.RequestID())
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Output: os.Stderr}))
+	concurrencyConfig, err := loadConcurrencyConfig(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.Use(loadSheddingMiddleware(concurrencyConfig))
+	rateLimitConfig, err := loadRateLimitConfig(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.Use(rateLimitMiddleware(rateLimitConfig, newRateLimitStore(os.Getenv("RATE_LIMIT_STORE"))))
 	e.Static("/", "public")
+	e.GET("/images/:key", getImageFileHandler)
 	e.GET("/", func(c echo.Context) error {
-		events, err := getEvents(false)
+		q, err := parseEventQuery(c)
+		if err != nil {
+			return err
+		}
+		events, total, nextCursor, err := searchEvents(q, false)
 		if err != nil {
 			return err
 		}
+		setEventSearchHeaders(c, total, nextCursor)
 		for i, v := range events {
 			events[i] = sanitizeEvent(v)
 		}
+		categories, err := getCategories()
+		if err != nil {
+			return err
+		}
 		return c.Render(200, "index.tmpl", echo.Map{
-			"events": events,
-			"user":   c.Get("user"),
-			"origin": c.Scheme() + "://" + c.Request().Host,
+			"events":     events,
+			"categories": categories,
+			"query":      q,
+			"user":       c.Get("user"),
+			"origin":     c.Scheme() + "://" + c.Request().Host,
 		})
 	}, fillinUser)
 	e.GET("/initialize", func(c echo.Context) error {
@@ -90,16 +139,21 @@ func main() {
 		if err != nil {
 			return nil
 		}
+		if err := writeAuditLog(db, c, "initialize", "system", 0, nil, nil); err != nil {
+			return err
+		}
 
 		return c.NoContent(204)
 	})
 	e.POST("/api/users", func(c echo.Context) error {
 		var params struct {
-			Nickname  string `json:"nickname"`
-			LoginName string `json:"login_name"`
-			Password  string `json:"password"`
+			Nickname  string `json:"nickname" validate:"required,max=128,charset=printable"`
+			LoginName string `json:"login_name" validate:"required,max=128,charset=loginname"`
+			Password  string `json:"password" validate:"required,max=128"`
+		}
+		if err := bindParams(c, &params); err != nil {
+			return err
 		}
-		c.Bind(&params)
 
 		tx, err := db.Begin()
 		if err != nil {
@@ -107,10 +161,10 @@ func main() {
 		}
 
 		var user User
-		if err := tx.QueryRow("SELECT * FROM users WHERE login_name = ?", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash); err != sql.ErrNoRows {
+		if err := tx.QueryRow("SELECT id, login_name, nickname, pass_hash FROM users WHERE login_name = ?", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash); err != sql.ErrNoRows {
 			tx.Rollback()
 			if err == nil {
-				return resError(c, "duplicated", 409)
+				return conflictError("duplicated")
 			}
 			return err
 		}
@@ -118,12 +172,17 @@ func main() {
 		res, err := tx.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, SHA2(?, 256), ?)", params.LoginName, params.Password, params.Nickname)
 		if err != nil {
 			tx.Rollback()
-			return resError(c, "", 0)
+			return err
 		}
 		userID, err := res.LastInsertId()
 		if err != nil {
 			tx.Rollback()
-			return resError(c, "", 0)
+			return err
+		}
+		setAuditActor(c, actorUser, userID)
+		if err := writeAuditLog(tx, c, "user.create", "user", userID, nil, echo.Map{"login_name": params.LoginName, "nickname": params.Nickname}); err != nil {
+			tx.Rollback()
+			return err
 		}
 		if err := tx.Commit(); err != nil {
 			return err
@@ -136,16 +195,21 @@ func main() {
 	})
 	e.GET("/api/users/:id", func(c echo.Context) error {
 		var user User
-		if err := db.QueryRow("SELECT id, nickname FROM users WHERE id = ?", c.Param("id")).Scan(&user.ID, &user.Nickname); err != nil {
+		var email sql.NullString
+		if err := db.QueryRow("SELECT id, nickname, email FROM users WHERE id = ?", c.Param("id")).Scan(&user.ID, &user.Nickname, &email); err != nil {
+			if err == sql.ErrNoRows {
+				return notFoundError("not_found")
+			}
 			return err
 		}
+		user.Email = email.String
 
 		loginUser, err := getLoginUser(c)
 		if err != nil {
 			return err
 		}
 		if user.ID != loginUser.ID {
-			return resError(c, "forbidden", 403)
+			return forbiddenError("forbidden")
 		}
 
 		rows, err := db.Query("SELECT r.*, s.rank AS sheet_rank, s.num AS sheet_num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ? ORDER BY IFNULL(r.canceled_at, r.reserved_at) DESC LIMIT 5", user.ID)
@@ -155,6 +219,7 @@ func main() {
 		defer rows.Close()
 
 		var recentReservations []Reservation
+		var eventIDs []int64
 		for rows.Next() {
 			var reservation Reservation
 			var sheet Sheet
@@ -162,24 +227,18 @@ func main() {
 				return err
 			}
 
-			event, err := getEvent(reservation.EventID, -1)
-			if err != nil {
-				return err
-			}
-			price := event.Sheets[sheet.Rank].Price
-			event.Sheets = nil
-			event.Total = 0
-			event.Remains = 0
-
-			reservation.Event = event
 			reservation.SheetRank = sheet.Rank
 			reservation.SheetNum = sheet.Num
-			reservation.Price = price
 			reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
 			if reservation.CanceledAt != nil {
 				reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
+			} else {
+				reservation.TicketURL = reservationTicketURL(reservation.UserID, reservation.ID)
 			}
 			recentReservations = append(recentReservations, reservation)
+			if !contains(eventIDs, reservation.EventID) {
+				eventIDs = append(eventIDs, reservation.EventID)
+			}
 		}
 		if recentReservations == nil {
 			recentReservations = make([]Reservation, 0)
@@ -196,44 +255,91 @@ func main() {
 		}
 		defer rows.Close()
 
-		var recentEvents []*Event
+		var recentEventIDs []int64
 		for rows.Next() {
 			var eventID int64
 			if err := rows.Scan(&eventID); err != nil {
 				return err
 			}
-			event, err := getEvent(eventID, -1)
-			if err != nil {
-				return err
+			recentEventIDs = append(recentEventIDs, eventID)
+			if !contains(eventIDs, eventID) {
+				eventIDs = append(eventIDs, eventID)
 			}
-			for k := range event.Sheets {
-				event.Sheets[k].Detail = nil
+		}
+
+		// 予約とイベントで必要なイベントをまとめて取得する
+		events, err := getEventSummaries(eventIDs)
+		if err != nil {
+			return err
+		}
+
+		for i, reservation := range recentReservations {
+			summary, ok := events[reservation.EventID]
+			if !ok {
+				return sql.ErrNoRows
 			}
-			recentEvents = append(recentEvents, event)
+			event := *summary
+			recentReservations[i].Price = event.Sheets[reservation.SheetRank].Price
+			event.Sheets = nil
+			event.Total = 0
+			event.Remains = 0
+			recentReservations[i].Event = &event
 		}
-		if recentEvents == nil {
-			recentEvents = make([]*Event, 0)
+
+		recentEvents := make([]*Event, 0, len(recentEventIDs))
+		for _, eventID := range recentEventIDs {
+			event, ok := events[eventID]
+			if !ok {
+				return sql.ErrNoRows
+			}
+			recentEvents = append(recentEvents, event)
 		}
 
 		return c.JSON(200, echo.Map{
 			"id":                  user.ID,
 			"nickname":            user.Nickname,
+			"email":               user.Email,
 			"recent_reservations": recentReservations,
 			"total_price":         totalPrice,
 			"recent_events":       recentEvents,
 		})
 	}, loginRequired)
+	e.GET("/api/users/:id/reservations", getReservationHistoryHandler, loginRequired)
+	e.GET("/api/users/:id/reservations/:reservation_id/ticket", getTicketHandler, loginRequired)
+	e.GET("/api/users/:id/reservations/:reservation_id/ticket/qr.png", getTicketQRHandler("png"), loginRequired)
+	e.GET("/api/users/:id/reservations/:reservation_id/ticket/qr.svg", getTicketQRHandler("svg"), loginRequired)
+	e.POST("/api/users/:id/reservations/:reservation_id/transfers", postTransferHandler, loginRequired)
+	e.GET("/api/users/:id/transfers", getTransfersHandler, loginRequired)
+	e.POST("/api/users/:id/reservations/:reservation_id/resale_listing", postResaleListingHandler, loginRequired)
+	e.POST("/api/users/:id/reservations/:reservation_id/actions/change_seat", changeSeatHandler, loginRequired)
+	e.GET("/api/users/:id/resale_listings", getUserResaleListingsHandler, loginRequired)
+	e.POST("/api/resale_listings/:id/actions/buy", buyResaleListingHandler, loginRequired)
+	e.POST("/api/resale_listings/:id/actions/withdraw", withdrawResaleListingHandler, loginRequired)
+	e.POST("/api/transfers/:id/actions/accept", acceptTransferHandler, loginRequired)
+	e.POST("/api/transfers/:id/actions/decline", closeTransferHandler(transferStatusDeclined), loginRequired)
+	e.POST("/api/transfers/:id/actions/cancel", closeTransferHandler(transferStatusCanceled), loginRequired)
+	e.POST("/api/users/:id/actions/edit", editUserHandler, loginRequired)
+	e.POST("/api/users/:id/actions/change_password", changeUserPasswordHandler, loginRequired)
+	e.DELETE("/api/users/:id", deleteUserHandler, loginRequired)
+	e.GET("/api/users/:id/notification_preferences", getNotificationPreferencesHandler, loginRequired)
+	e.POST("/api/users/:id/notification_preferences/actions/edit", editNotificationPreferencesHandler, loginRequired)
 	e.POST("/api/actions/login", func(c echo.Context) error {
 		var params struct {
-			LoginName string `json:"login_name"`
-			Password  string `json:"password"`
+			LoginName string `json:"login_name" validate:"required,max=128"`
+			Password  string `json:"password" validate:"required,max=128"`
+		}
+		if err := bindParams(c, &params); err != nil {
+			return err
+		}
+
+		if ok, err := checkLogin(c, loginScopeUser, params.LoginName); !ok {
+			return err
 		}
-		c.Bind(&params)
 
 		user := new(User)
-		if err := db.QueryRow("SELECT * FROM users WHERE login_name = ?", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash); err != nil {
+		if err := db.QueryRow("SELECT id, login_name, nickname, pass_hash, session_version FROM users WHERE login_name = ? AND deleted_at IS NULL", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash, &user.SessionVersion); err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "authentication_failed", 401)
+				return resLoginFailed(c, loginScopeUser, params.LoginName)
 			}
 			return err
 		}
@@ -243,34 +349,52 @@ func main() {
 			return err
 		}
 		if user.PassHash != passHash {
-			return resError(c, "authentication_failed", 401)
+			return resLoginFailed(c, loginScopeUser, params.LoginName)
+		}
+		if err := recordLoginSuccess(c, loginScopeUser, params.LoginName); err != nil {
+			return err
 		}
 
-		sessSetUserID(c, user.ID)
+		sessSetUserID(c, user.ID, user.SessionVersion)
+		setAuditActor(c, actorUser, user.ID)
+		if err := writeAuditLog(db, c, "user.login", "user", user.ID, nil, nil); err != nil {
+			return err
+		}
 		user, err = getLoginUser(c)
 		if err != nil {
 			return err
 		}
 		return c.JSON(200, user)
 	})
+	e.POST("/api/password_resets", requestPasswordResetHandler)
+	e.POST("/api/password_resets/actions/confirm", confirmPasswordResetHandler)
 	e.POST("/api/actions/logout", func(c echo.Context) error {
+		if err := writeAuditLog(db, c, "user.logout", "user", sessUserID(c), nil, nil); err != nil {
+			return err
+		}
 		sessDeleteUserID(c)
 		return c.NoContent(204)
 	}, loginRequired)
 	e.GET("/api/events", func(c echo.Context) error {
-		events, err := getEvents(true)
+		q, err := parseEventQuery(c)
 		if err != nil {
 			return err
 		}
+		events, total, nextCursor, err := searchEvents(q, true)
+		if err != nil {
+			return err
+		}
+		setEventSearchHeaders(c, total, nextCursor)
 		for i, v := range events {
 			events[i] = sanitizeEvent(v)
 		}
 		return c.JSON(200, events)
 	})
+	e.GET("/api/categories", getCategoriesHandler)
 	e.GET("/api/events/:id", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
 		}
 
 		loginUserID := int64(-1)
@@ -281,23 +405,38 @@ func main() {
 		event, err := getEvent(eventID, loginUserID)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "not_found", 404)
+				return notFoundError("not_found")
 			}
 			return err
 		} else if !event.PublicFg {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
+		}
+		if err := attachEventDetails(event); err != nil {
+			return err
+		}
+		if event.Sale, err = getSaleStatus(event.ID, loginUserID, time.Now()); err != nil {
+			return err
+		}
+		if event.Transfers, err = getTransferPolicy(db, event.ID); err != nil {
+			return err
+		}
+		if event.Resale, err = getResalePolicy(db, event.ID); err != nil {
+			return err
 		}
 		return c.JSON(200, sanitizeEvent(event))
 	})
 	e.POST("/api/events/:id/actions/reserve", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
 		}
+		// sheet_rank is checked by validateRank below to keep the invalid_rank error code
 		var params struct {
 			Rank string `json:"sheet_rank"`
 		}
-		c.Bind(&params)
+		if err := bindParams(c, &params); err != nil {
+			return err
+		}
 
 		user, err := getLoginUser(c)
 		if err != nil {
@@ -307,15 +446,25 @@ func main() {
 		event, err := getEvent(eventID, user.ID)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "invalid_event", 404)
+				return notFoundError("invalid_event")
 			}
 			return err
 		} else if !event.PublicFg {
-			return resError(c, "invalid_event", 404)
+			return notFoundError("invalid_event")
 		}
 
 		if !validateRank(params.Rank) {
-			return resError(c, "invalid_rank", 400)
+			return validationError("invalid_rank")
+		}
+		if err := checkSalePhase(event.ID, user.ID); err != nil {
+			return err
+		}
+		if err := checkLotterySale(event.ID); err != nil {
+			return err
+		}
+		ticketID, err := requireQueueAdmission(c, event.ID, user.ID)
+		if err != nil {
+			return err
 		}
 
 		var sheets []Sheet
@@ -323,7 +472,7 @@ func main() {
 
 		rows, err := db.Query("SELECT * FROM sheets WHERE id NOT IN (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL ) AND `rank` = ?", event.ID, params.Rank)
 		if err == sql.ErrNoRows {
-			return resError(c, "sold_out", 409)
+			return soldOutError()
 		}
 		if err != nil {
 			return err
@@ -337,6 +486,9 @@ func main() {
 			}
 			sheets = append(sheets, sheet)
 		}
+		if len(sheets) == 0 {
+			return soldOutError()
+		}
 
 		var sheet Sheet
 		for {
@@ -344,6 +496,14 @@ func main() {
 			if err != nil {
 				return err
 			}
+			if err := checkPurchaseLimits(tx, user.ID, event.ID, params.Rank); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := useQueueAdmission(tx, ticketID); err != nil {
+				tx.Rollback()
+				return err
+			}
 			rand.Seed(time.Now().UnixNano())
 			sheet = sheets[rand.Intn(len(sheets))]
 			res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?)", event.ID, sheet.ID, user.ID, time.Now().UTC().Format("2006-01-02 15:04:05.000000"))
@@ -358,6 +518,20 @@ func main() {
 				log.Println("re-try: rollback by", err)
 				continue
 			}
+			if err := writeAuditLog(tx, c, "reservation.create", "reservation", reservationID, nil, echo.Map{"event_id": event.ID, "sheet_rank": sheet.Rank, "sheet_num": sheet.Num, "user_id": user.ID}); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := enqueueNotification(tx, user.ID, notificationReservationConfirmed, map[string]interface{}{
+				"Title": event.Title, "SheetRank": sheet.Rank, "SheetNum": sheet.Num, "ReservationID": reservationID,
+			}); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := enqueueWebhookEvent(tx, webhookReservationCreated, echo.Map{"reservation_id": reservationID, "event_id": event.ID, "user_id": user.ID, "sheet_rank": sheet.Rank, "sheet_num": sheet.Num, "price": event.Price + sheet.Price}); err != nil {
+				tx.Rollback()
+				return err
+			}
 			if err := tx.Commit(); err != nil {
 				tx.Rollback()
 				log.Println("re-try: rollback by", err)
@@ -372,15 +546,22 @@ func main() {
 			"sheet_num":  sheet.Num,
 		})
 	}, loginRequired)
+	e.POST("/api/events/:id/queue/actions/join", joinQueueHandler, loginRequired)
+	e.GET("/api/events/:id/resale_listings", getResaleListingsHandler)
+	e.GET("/api/events/:id/queue", getQueueStatusHandler, loginRequired)
+	e.POST("/api/events/:id/actions/redeem_access_code", redeemAccessCodeHandler, loginRequired)
+	e.GET("/api/events/:id/lottery/entry", getMyLotteryEntryHandler, loginRequired)
+	e.POST("/api/events/:id/lottery/entry", applyLotteryHandler, loginRequired)
+	e.DELETE("/api/events/:id/lottery/entry", withdrawLotteryHandler, loginRequired)
 	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
 		}
 		rank := c.Param("rank")
 		num, err := strconv.ParseInt(c.Param("num"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
 		}
 
 		user, err := getLoginUser(c)
@@ -389,24 +570,24 @@ func main() {
 		}
 
 		var event Event
-		err = db.QueryRow("SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price)
+		err = db.QueryRow("SELECT id, title, public_fg, closed_fg, price, start_at FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.StartAt)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "invalid_event", 404)
+				return notFoundError("invalid_event")
 			}
 			return err
 		} else if !event.PublicFg {
-			return resError(c, "invalid_event", 404)
+			return notFoundError("invalid_event")
 		}
 
 		if !validateRank(rank) {
-			return resError(c, "invalid_rank", 404)
+			return notFoundError("invalid_rank")
 		}
 
 		var sheet Sheet
 		if err := db.QueryRow("SELECT * FROM sheets WHERE `rank` = ? AND num = ?", rank, num).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "invalid_sheet", 404)
+				return notFoundError("invalid_sheet")
 			}
 			return err
 		}
@@ -417,19 +598,29 @@ func main() {
 		}
 
 		var reservation Reservation
-		if err := tx.QueryRow("SELECT * FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id HAVING reserved_at = MIN(reserved_at) ", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt); err != nil {
+		// チェックイン・リセール購入と同時に来ても片方だけが通るよう予約行をロックして読む
+		if err := tx.QueryRow("SELECT * FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL ORDER BY reserved_at LIMIT 1 FOR UPDATE", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt); err != nil {
 			tx.Rollback()
 			if err == sql.ErrNoRows {
-				return resError(c, "not_reserved", 400)
+				return validationError("not_reserved")
 			}
 			return err
 		}
 		if reservation.UserID != user.ID {
 			tx.Rollback()
-			return resError(c, "not_permitted", 403)
+			return forbiddenError("not_permitted")
+		}
+		var checkedIn int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM checkins WHERE reservation_id = ?", reservation.ID).Scan(&checkedIn); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if checkedIn > 0 {
+			tx.Rollback()
+			return conflictError("already_checked_in")
 		}
 
-		if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
+		if err := cancelReservation(tx, c, &reservation, &event, &sheet); err != nil {
 			tx.Rollback()
 			return err
 		}
@@ -457,15 +648,22 @@ func main() {
 	}, fillinAdministrator)
 	e.POST("/admin/api/actions/login", func(c echo.Context) error {
 		var params struct {
-			LoginName string `json:"login_name"`
-			Password  string `json:"password"`
+			LoginName string `json:"login_name" validate:"required,max=128"`
+			Password  string `json:"password" validate:"required,max=128"`
+			OTP       string `json:"otp" validate:"max=32"`
+		}
+		if err := bindParams(c, &params); err != nil {
+			return err
+		}
+
+		if ok, err := checkLogin(c, loginScopeAdmin, params.LoginName); !ok {
+			return err
 		}
-		c.Bind(&params)
 
 		administrator := new(Administrator)
-		if err := db.QueryRow("SELECT * FROM administrators WHERE login_name = ?", params.LoginName).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.PassHash); err != nil {
+		if err := db.QueryRow("SELECT id, login_name, nickname, pass_hash, totp_enabled_fg, session_version FROM administrators WHERE login_name = ? AND active_fg = 1", params.LoginName).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.PassHash, &administrator.TOTPEnabled, &administrator.SessionVersion); err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "authentication_failed", 401)
+				return resLoginFailed(c, loginScopeAdmin, params.LoginName)
 			}
 			return err
 		}
@@ -475,10 +673,36 @@ func main() {
 			return err
 		}
 		if administrator.PassHash != passHash {
-			return resError(c, "authentication_failed", 401)
+			return resLoginFailed(c, loginScopeAdmin, params.LoginName)
+		}
+		if administrator.TOTPEnabled {
+			if params.OTP == "" {
+				return unauthorizedError("totp_required")
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			if err := verifyAdministratorSecondFactor(tx, administrator.ID, params.OTP); err != nil {
+				tx.Rollback()
+				if err == errTOTPInvalidCode {
+					return resLoginFailed(c, loginScopeAdmin, params.LoginName)
+				}
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+		}
+		if err := recordLoginSuccess(c, loginScopeAdmin, params.LoginName); err != nil {
+			return err
 		}
 
-		sessSetAdministratorID(c, administrator.ID)
+		sessSetAdministratorID(c, administrator.ID, administrator.SessionVersion)
+		setAuditActor(c, actorAdmin, administrator.ID)
+		if err := writeAuditLog(db, c, "admin.login", "administrator", administrator.ID, nil, nil); err != nil {
+			return err
+		}
 		administrator, err = getLoginAdministrator(c)
 		if err != nil {
 			return err
@@ -486,9 +710,23 @@ func main() {
 		return c.JSON(200, administrator)
 	})
 	e.POST("/admin/api/actions/logout", func(c echo.Context) error {
+		if err := writeAuditLog(db, c, "admin.logout", "administrator", sessAdministratorID(c), nil, nil); err != nil {
+			return err
+		}
 		sessDeleteAdministratorID(c)
 		return c.NoContent(204)
 	}, adminLoginRequired)
+	e.POST("/admin/api/totp/actions/enroll", enrollTOTPHandler, adminSessionRequired)
+	e.POST("/admin/api/totp/actions/activate", activateTOTPHandler, adminSessionRequired)
+	e.POST("/admin/api/totp/actions/disable", disableTOTPHandler, adminLoginRequired)
+	e.POST("/admin/api/totp/actions/recovery_codes", regenerateRecoveryCodesHandler, adminLoginRequired)
+	e.GET("/admin/api/administrators", getAdministratorsHandler, superadminRequired)
+	e.POST("/admin/api/administrators", postAdministratorsHandler, superadminRequired)
+	e.POST("/admin/api/administrators/:id/actions/edit", editAdministratorHandler, adminLoginRequired)
+	e.POST("/admin/api/administrators/:id/actions/role", changeAdministratorRoleHandler, superadminRequired)
+	e.POST("/admin/api/administrators/:id/actions/deactivate", setAdministratorActiveHandler(false), superadminRequired)
+	e.POST("/admin/api/administrators/:id/actions/activate", setAdministratorActiveHandler(true), superadminRequired)
+	e.POST("/admin/api/administrators/:id/actions/totp_policy", changeTOTPPolicyHandler, superadminRequired)
 	e.GET("/admin/api/events", func(c echo.Context) error {
 		events, err := getEvents(true)
 		if err != nil {
@@ -498,18 +736,32 @@ func main() {
 	}, adminLoginRequired)
 	e.POST("/admin/api/events", func(c echo.Context) error {
 		var params struct {
-			Title  string `json:"title"`
+			Title  string `json:"title" validate:"required,max=128,charset=printable"`
 			Public bool   `json:"public"`
-			Price  int    `json:"price"`
+			Price  int    `json:"price" validate:"min=0,max=1000000"`
+
+			StartAt int64 `json:"start_at" validate:"min=0"`
+
+			eventDetailsParams
+		}
+		if err := bindParams(c, &params); err != nil {
+			return err
+		}
+		if err := params.eventDetailsParams.validate(); err != nil {
+			return err
+		}
+		var startAt *time.Time
+		if params.StartAt > 0 {
+			t := time.Unix(params.StartAt, 0).UTC()
+			startAt = &t
 		}
-		c.Bind(&params)
 
 		tx, err := db.Begin()
 		if err != nil {
 			return err
 		}
 
-		res, err := tx.Exec("INSERT INTO events (title, public_fg, closed_fg, price) VALUES (?, ?, 0, ?)", params.Title, params.Public, params.Price)
+		res, err := tx.Exec("INSERT INTO events (title, public_fg, closed_fg, price, start_at) VALUES (?, ?, 0, ?, ?)", params.Title, params.Public, params.Price, startAt)
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -519,6 +771,14 @@ func main() {
 			tx.Rollback()
 			return err
 		}
+		if err := saveEventDetails(tx, eventID, &params.eventDetailsParams); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := writeAuditLog(tx, c, "event.create", "event", eventID, nil, echo.Map{"title": params.Title, "public": params.Public, "closed": false, "price": params.Price, "start_at": params.StartAt, "details": &params.eventDetailsParams}); err != nil {
+			tx.Rollback()
+			return err
+		}
 		if err := tx.Commit(); err != nil {
 			return err
 		}
@@ -527,33 +787,50 @@ func main() {
 		if err != nil {
 			return err
 		}
+		if err := attachEventDetails(event); err != nil {
+			return err
+		}
 		return c.JSON(200, event)
 	}, adminLoginRequired)
 	e.GET("/admin/api/events/:id", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
 		}
 		event, err := getEvent(eventID, -1)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "not_found", 404)
+				return notFoundError("not_found")
 			}
 			return err
 		}
+		if err := attachEventDetails(event); err != nil {
+			return err
+		}
+		if event.Attendance, err = getAttendance(event.ID); err != nil {
+			return err
+		}
+		if event.Transfers, err = getTransferPolicy(db, event.ID); err != nil {
+			return err
+		}
+		if event.Resale, err = getResalePolicy(db, event.ID); err != nil {
+			return err
+		}
 		return c.JSON(200, event)
 	}, adminLoginRequired)
 	e.POST("/admin/api/events/:id/actions/edit", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
 		}
 
 		var params struct {
 			Public bool `json:"public"`
 			Closed bool `json:"closed"`
 		}
-		c.Bind(&params)
+		if err := bindParams(c, &params); err != nil {
+			return err
+		}
 		if params.Closed {
 			params.Public = false
 		}
@@ -561,15 +838,15 @@ func main() {
 		event, err := getEvent(eventID, -1)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "not_found", 404)
+				return notFoundError("not_found")
 			}
 			return err
 		}
 
 		if event.ClosedFg {
-			return resError(c, "cannot_edit_closed_event", 400)
+			return validationError("cannot_edit_closed_event")
 		} else if event.PublicFg && params.Closed {
-			return resError(c, "cannot_close_public_event", 400)
+			return validationError("cannot_close_public_event")
 		}
 
 		tx, err := db.Begin()
@@ -580,6 +857,27 @@ func main() {
 			tx.Rollback()
 			return err
 		}
+		if err := writeAuditLog(tx, c, "event.edit", "event", event.ID,
+			echo.Map{"public": event.PublicFg, "closed": event.ClosedFg},
+			echo.Map{"public": params.Public, "closed": params.Closed}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		webhookType := ""
+		switch {
+		case params.Closed:
+			webhookType = webhookEventClosed
+		case params.Public && !event.PublicFg:
+			webhookType = webhookEventOpened
+		case !params.Public && event.PublicFg:
+			webhookType = webhookEventUnpublished
+		}
+		if webhookType != "" {
+			if err := enqueueWebhookEvent(tx, webhookType, echo.Map{"event_id": event.ID, "title": event.Title, "public": params.Public, "closed": params.Closed}); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
 		if err := tx.Commit(); err != nil {
 			return err
 		}
@@ -588,13 +886,42 @@ func main() {
 		if err != nil {
 			return err
 		}
+		if err := attachEventDetails(e); err != nil {
+			return err
+		}
 		c.JSON(200, e)
 		return nil
 	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/edit_details", editEventDetailsHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/edit_limits", editPurchaseLimitsHandler, adminLoginRequired)
+	e.GET("/admin/api/events/:id/queue", getEventQueueHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/queue/actions/edit", editEventQueueHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/queue/actions/pause", pauseEventQueueHandler(true), adminLoginRequired)
+	e.POST("/admin/api/events/:id/queue/actions/resume", pauseEventQueueHandler(false), adminLoginRequired)
+	e.GET("/admin/api/events/:id/sale_phases", getSalePhasesHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/sale_phases", postSalePhasesHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/sale_phases/:phase_id/actions/edit", editSalePhaseHandler, adminLoginRequired)
+	e.DELETE("/admin/api/events/:id/sale_phases/:phase_id", deleteSalePhaseHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/sale_phases/:phase_id/actions/add_users", editSalePhaseUsersHandler(true), adminLoginRequired)
+	e.POST("/admin/api/events/:id/sale_phases/:phase_id/actions/remove_users", editSalePhaseUsersHandler(false), adminLoginRequired)
+	e.POST("/admin/api/events/:id/checkins", postCheckinHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/checkins/actions/sync", syncCheckinsHandler, adminLoginRequired)
+	e.GET("/admin/api/events/:id/attendance", getAttendanceHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/edit_transfer_policy", editTransferPolicyHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/edit_resale_policy", editResalePolicyHandler, adminLoginRequired)
+	e.GET("/admin/api/events/:id/lottery", getLotteryHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/lottery/actions/edit", editLotteryHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/lottery/actions/draw", drawLotteryHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/lottery/actions/publish", publishLotteryHandler, adminLoginRequired)
+	e.POST("/admin/api/images", uploadImageHandler, adminLoginRequired)
+	e.GET("/admin/api/categories", getCategoriesHandler, adminLoginRequired)
+	e.POST("/admin/api/categories", postCategoriesHandler, adminLoginRequired)
+	e.POST("/admin/api/categories/:id/actions/edit", editCategoryHandler, adminLoginRequired)
+	e.POST("/admin/api/users/:id/actions/edit_groups", editUserGroupsHandler, adminLoginRequired)
 	e.GET("/admin/api/reports/events/:id/sales", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return notFoundError("not_found")
 		}
 
 		event, err := getEvent(eventID, -1)
@@ -618,7 +945,7 @@ func main() {
 
 			sheet, ok := getSheetByID(reservation.SheetID)
 			if ok < 0 {
-				return resError(c, "not_found", 404)
+				return notFoundError("not_found")
 			}
 
 			report := Report{
@@ -635,8 +962,27 @@ func main() {
 			}
 			reports = append(reports, report)
 		}
-		return renderReportCSV(c, reports)
+		extended := c.QueryParam("extended") == "1"
+		if extended {
+			if err := extendReports(reports, event.ID); err != nil {
+				return err
+			}
+		}
+		return renderReportCSV(c, reports, extended)
 	}, adminLoginRequired)
+	e.GET("/admin/api/login_locks", getLoginLocksHandler, adminLoginRequired)
+	e.POST("/admin/api/login_locks/actions/unlock", unlockLoginHandler, adminLoginRequired)
+	e.GET("/admin/api/audit_logs", getAuditLogsHandler, adminLoginRequired)
+	e.GET("/admin/api/notifications", getNotificationsHandler, adminLoginRequired)
+	e.POST("/admin/api/notifications/:id/actions/retry", retryNotificationHandler, adminLoginRequired)
+	e.GET("/admin/api/webhooks", getWebhooksHandler, adminLoginRequired)
+	e.POST("/admin/api/webhooks", postWebhooksHandler, adminLoginRequired)
+	e.POST("/admin/api/webhooks/:id/actions/edit", editWebhookHandler, adminLoginRequired)
+	e.POST("/admin/api/webhooks/:id/actions/rotate_secret", rotateWebhookSecretHandler, adminLoginRequired)
+	e.DELETE("/admin/api/webhooks/:id", deleteWebhookHandler, adminLoginRequired)
+	e.GET("/admin/api/webhooks/:id/deliveries", getWebhookDeliveriesHandler, adminLoginRequired)
+	e.POST("/admin/api/webhook_deliveries/:id/actions/redeliver", redeliverWebhookHandler, adminLoginRequired)
+	e.GET("/admin/api/reports/audit_logs", getAuditLogsReportHandler, adminLoginRequired)
 	e.GET("/admin/api/reports/sales", func(c echo.Context) error {
 		rows, err := db.Query("SELECT r.*, e.id, e.price FROM reservations r INNER JOIN events e ON e.id = r.event_id ORDER BY reserved_at ASC ")
 		if err != nil {
@@ -656,7 +1002,7 @@ func main() {
 
 			sheet, ok := getSheetByID(reservation.SheetID)
 			if ok < 0 {
-				return resError(c, "not_found", 404)
+				return notFoundError("not_found")
 			}
 
 			report := Report{
@@ -673,30 +1019,67 @@ func main() {
 			}
 			reports = append(reports, report)
 		}
-		return renderReportCSV(c, reports)
+		extended := c.QueryParam("extended") == "1"
+		if extended {
+			if err := extendReports(reports, 0); err != nil {
+				return err
+			}
+		}
+		return renderReportCSV(c, reports, extended)
 	}, adminLoginRequired)
 
 	e.Start(":8080")
 }
 
 type Report struct {
-	ReservationID int64
-	EventID       int64
-	Rank          string
-	Num           int64
-	UserID        int64
-	SoldAt        string
-	CanceledAt    string
-	Price         int64
+	ReservationID   int64
+	EventID         int64
+	Rank            string
+	Num             int64
+	UserID          int64
+	SoldAt          string
+	CanceledAt      string
+	Price           int64
+	PurchaserUserID int64
+	TransferredAt   string
+	SaleType        string
+	ResaleOf        int64
+	ResalePrice     int64
+	ResaleFee       int64
+	ChangeOf        int64
+	PriceDifference int64
 }
 
-func renderReportCSV(c echo.Context, reports []Report) error {
+// extendReports fills in the columns of the extended sales report (?extended=1):
+// transfers, resales and seat changes. eventID 0 means all events.
+func extendReports(reports []Report, eventID int64) error {
+	if err := applyTransferHistory(reports, eventID); err != nil {
+		return err
+	}
+	if err := applyResaleSales(reports, eventID); err != nil {
+		return err
+	}
+	return applySeatChanges(reports, eventID)
+}
+
+// renderReportCSV writes the sales report. The first eight columns are always
+// the same; the extended report appends the columns of extendReports after them.
+func renderReportCSV(c echo.Context, reports []Report, extended bool) error {
 	sort.Slice(reports, func(i, j int) bool { return strings.Compare(reports[i].SoldAt, reports[j].SoldAt) < 0 })
 
-	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at\n")
+	header := "reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at"
+	if extended {
+		header += ",purchaser_user_id,transferred_at,sale_type,resale_of,resale_price,resale_fee,change_of,price_difference"
+	}
+	body := bytes.NewBufferString(header + "\n")
 	for _, v := range reports {
-		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s\n",
+		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s",
 			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt))
+		if extended {
+			body.WriteString(fmt.Sprintf(",%d,%s,%s,%d,%d,%d,%d,%d",
+				v.PurchaserUserID, v.TransferredAt, v.SaleType, v.ResaleOf, v.ResalePrice, v.ResaleFee, v.ChangeOf, v.PriceDifference))
+		}
+		body.WriteString("\n")
 	}
 
 	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
@@ -705,9 +1088,11 @@ func renderReportCSV(c echo.Context, reports []Report) error {
 	return err
 }
 
+// resError writes the {"error": code} body. Handlers return DomainErrors instead
+// of calling this directly; httpErrorHandler is the only caller.
 func resError(c echo.Context, e string, status int) error {
 	if e == "" {
-		e = "unknown"
+		e = "internal_error"
 	}
 	if status < 100 {
 		status = 500
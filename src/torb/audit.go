@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	actorUser   = "user"
+	actorAdmin  = "admin"
+	actorSystem = "system"
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx so that audit logs can be
+// written inside the transaction of the mutation they describe.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryRower and queryer are satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type AuditLog struct {
+	ID         int64           `json:"id"`
+	ActorType  string          `json:"actor_type"`
+	ActorID    int64           `json:"actor_id"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   int64           `json:"target_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	RequestID  string          `json:"request_id"`
+	ClientIP   string          `json:"client_ip"`
+	CreatedAt  *time.Time      `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+type auditActor struct {
+	Type string
+	ID   int64
+}
+
+// setAuditActor overrides the actor recorded for the current request, e.g. for
+// signup where nobody is logged in yet.
+func setAuditActor(c echo.Context, actorType string, id int64) {
+	c.Set("audit_actor", auditActor{Type: actorType, ID: id})
+}
+
+func actorOf(c echo.Context) auditActor {
+	if c == nil {
+		return auditActor{Type: actorSystem}
+	}
+	if actor, ok := c.Get("audit_actor").(auditActor); ok {
+		return actor
+	}
+	if strings.HasPrefix(c.Path(), "/admin/") {
+		if administratorID := sessAdministratorID(c); administratorID != 0 {
+			return auditActor{Type: actorAdmin, ID: administratorID}
+		}
+	}
+	if userID := sessUserID(c); userID != 0 {
+		return auditActor{Type: actorUser, ID: userID}
+	}
+	return auditActor{Type: actorSystem}
+}
+
+func marshalAuditValue(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// writeAuditLog appends an entry to audit_logs. c may be nil for actions that
+// are not triggered by an HTTP request (CLI, background workers).
+func writeAuditLog(q execer, c echo.Context, action, targetType string, targetID int64, before, after interface{}) error {
+	actor := actorOf(c)
+	var requestID, ip string
+	if c != nil {
+		requestID = c.Response().Header().Get(echo.HeaderXRequestID)
+		ip = clientIP(c)
+	}
+	beforeValue, err := marshalAuditValue(before)
+	if err != nil {
+		return err
+	}
+	afterValue, err := marshalAuditValue(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec("INSERT INTO audit_logs (actor_type, actor_id, action, target_type, target_id, before_value, after_value, request_id, client_ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		actor.Type, actor.ID, action, targetType, targetID, beforeValue, afterValue, requestID, ip, time.Now().UTC().Format("2006-01-02 15:04:05.000000"))
+	return err
+}
+
+// auditLogFilter builds the WHERE clause shared by the audit log API and CSV export.
+func auditLogFilter(c echo.Context) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, key := range []string{"actor_type", "action", "target_type", "request_id", "client_ip"} {
+		if v := c.QueryParam(key); v != "" {
+			conds = append(conds, key+" = ?")
+			args = append(args, v)
+		}
+	}
+	for _, key := range []string{"actor_id", "target_id"} {
+		if v, err := strconv.ParseInt(c.QueryParam(key), 10, 64); err == nil {
+			conds = append(conds, key+" = ?")
+			args = append(args, v)
+		}
+	}
+	if v, err := strconv.ParseInt(c.QueryParam("since"), 10, 64); err == nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, time.Unix(v, 0).UTC())
+	}
+	if v, err := strconv.ParseInt(c.QueryParam("until"), 10, 64); err == nil {
+		conds = append(conds, "created_at < ?")
+		args = append(args, time.Unix(v, 0).UTC())
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func queryAuditLogs(query string, args ...interface{}) ([]*AuditLog, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := make([]*AuditLog, 0)
+	for rows.Next() {
+		var entry AuditLog
+		var before, after sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.ActorType, &entry.ActorID, &entry.Action, &entry.TargetType, &entry.TargetID, &before, &after, &entry.RequestID, &entry.ClientIP, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entry.CreatedAtUnix = entry.CreatedAt.Unix()
+		logs = append(logs, &entry)
+	}
+	return logs, rows.Err()
+}
+
+// getAuditLogsHandler returns audit logs newest first. Pagination is done with
+// the `cursor` parameter, which is the id of the last entry of the previous page.
+func getAuditLogsHandler(c echo.Context) error {
+	where, args := auditLogFilter(c)
+	if cursor, err := strconv.ParseInt(c.QueryParam("cursor"), 10, 64); err == nil {
+		if where == "" {
+			where = " WHERE id < ?"
+		} else {
+			where += " AND id < ?"
+		}
+		args = append(args, cursor)
+	}
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 50
+	}
+
+	logs, err := queryAuditLogs("SELECT * FROM audit_logs"+where+" ORDER BY id DESC LIMIT "+strconv.Itoa(limit), args...)
+	if err != nil {
+		return err
+	}
+
+	var nextCursor int64
+	if len(logs) == limit {
+		nextCursor = logs[len(logs)-1].ID
+	}
+	return c.JSON(200, echo.Map{
+		"logs":        logs,
+		"next_cursor": nextCursor,
+	})
+}
+
+func getAuditLogsReportHandler(c echo.Context) error {
+	where, args := auditLogFilter(c)
+	logs, err := queryAuditLogs("SELECT * FROM audit_logs"+where+" ORDER BY id ASC", args...)
+	if err != nil {
+		return err
+	}
+
+	body := new(bytes.Buffer)
+	w := csv.NewWriter(body)
+	w.Write([]string{"id", "created_at", "actor_type", "actor_id", "action", "target_type", "target_id", "before", "after", "request_id", "client_ip"})
+	for _, v := range logs {
+		w.Write([]string{
+			strconv.FormatInt(v.ID, 10),
+			v.CreatedAt.Format("2006-01-02T15:04:05.000000Z"),
+			v.ActorType,
+			strconv.FormatInt(v.ActorID, 10),
+			v.Action,
+			v.TargetType,
+			strconv.FormatInt(v.TargetID, 10),
+			string(v.Before),
+			string(v.After),
+			v.RequestID,
+			v.ClientIP,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
+	c.Response().Header().Set("Content-Disposition", `attachment; filename="audit_logs.csv"`)
+	_, err = io.Copy(c.Response(), body)
+	return err
+}
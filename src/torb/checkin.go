@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	checkinSourceLive = "live"
+	checkinSourceSync = "sync"
+
+	checkinSyncMaxScans = 1000
+	// オフライン端末の時計のずれをこの程度まで許す
+	checkinClockSkew = 5 * time.Minute
+)
+
+// CheckIn records that the holder of a ticket entered through a gate. There
+// is at most one per reservation. The table is the audit trail of check-ins,
+// so they are not written to the audit log.
+type CheckIn struct {
+	ReservationID   int64     `json:"reservation_id"`
+	EventID         int64     `json:"event_id"`
+	SheetRank       string    `json:"sheet_rank"`
+	SheetNum        int64     `json:"sheet_num"`
+	Gate            string    `json:"gate"`
+	Source          string    `json:"source"`
+	CheckedInAt     time.Time `json:"-"`
+	CheckedInAtUnix int64     `json:"checked_in_at"`
+}
+
+type RankAttendance struct {
+	Reserved  int `json:"reserved"`
+	CheckedIn int `json:"checked_in"`
+}
+
+// Attendance counts active reservations and check-ins of an event.
+type Attendance struct {
+	Reserved  int                        `json:"reserved"`
+	CheckedIn int                        `json:"checked_in"`
+	Ranks     map[string]*RankAttendance `json:"ranks"`
+	Gates     map[string]int             `json:"gates"`
+}
+
+// checkInTicket validates the token for the event and records the check-in
+// at the given time. When the ticket was already used, the earlier check-in
+// is returned with already_checked_in.
+func checkInTicket(tx *sql.Tx, eventID int64, token, gate string, at time.Time, administratorID int64, source string) (*CheckIn, error) {
+	ticket, err := verifyTicket(tx, token)
+	if err != nil {
+		return nil, err
+	}
+	if ticket.EventID != eventID {
+		return nil, conflictError("wrong_event")
+	}
+
+	// キャンセルや譲渡と同時に来ても片方だけが通るよう予約行をロックし、
+	// ロック後の状態で確かめ直す
+	var canceled bool
+	if err := tx.QueryRow("SELECT canceled_at IS NOT NULL FROM reservations WHERE id = ? AND user_id = ? FOR UPDATE", ticket.ReservationID, ticket.UserID).Scan(&canceled); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, conflictError("ticket_transferred")
+		}
+		return nil, err
+	}
+	if canceled {
+		return nil, conflictError("ticket_canceled")
+	}
+
+	checkin := &CheckIn{ReservationID: ticket.ReservationID, EventID: eventID, SheetRank: ticket.SheetRank, SheetNum: ticket.SheetNum}
+	err = tx.QueryRow("SELECT gate, source, checked_in_at FROM checkins WHERE reservation_id = ?", ticket.ReservationID).Scan(&checkin.Gate, &checkin.Source, &checkin.CheckedInAt)
+	if err == nil {
+		checkin.CheckedInAtUnix = checkin.CheckedInAt.Unix()
+		return checkin, conflictError("already_checked_in")
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	checkin.Gate = gate
+	checkin.Source = source
+	checkin.CheckedInAt = at.UTC()
+	checkin.CheckedInAtUnix = at.Unix()
+	if _, err := tx.Exec("INSERT INTO checkins (reservation_id, event_id, gate, source, administrator_id, checked_in_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		checkin.ReservationID, eventID, gate, source, administratorID, checkin.CheckedInAt, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return checkin, nil
+}
+
+// postCheckinHandler checks in one scanned ticket at a gate.
+func postCheckinHandler(c echo.Context) error {
+	if err := requireTicketSigningKey(); err != nil {
+		return err
+	}
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params struct {
+		Token string `json:"token" validate:"required,max=512,charset=printable"`
+		Gate  string `json:"gate" validate:"required,max=32,charset=loginname"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	checkin, err := checkInTicket(tx, eventID, params.Token, params.Gate, time.Now(), administrator.ID, checkinSourceLive)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(201, checkin)
+}
+
+type checkinSyncResult struct {
+	Index   int      `json:"index"`
+	Status  string   `json:"status"`
+	CheckIn *CheckIn `json:"checkin,omitempty"`
+}
+
+// syncCheckinsHandler uploads the scans an offline scanner collected. Each
+// scan is applied in its own transaction, oldest first, with its scan time as
+// the check-in time, so within a batch the first scan of a ticket wins. A
+// check-in that is already recorded is kept as it is, even when the synced
+// scan is earlier: the scan reports already_checked_in with the recorded
+// check-in. Uploading the same batch again is harmless: a scan that matches
+// the recorded check-in (gate and time) reports checked_in again.
+//
+// Every scan gets a status: checked_in, already_checked_in, invalid_ticket,
+// ticket_canceled, ticket_transferred, wrong_event or invalid_scanned_at.
+func syncCheckinsHandler(c echo.Context) error {
+	if err := requireTicketSigningKey(); err != nil {
+		return err
+	}
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params struct {
+		Gate  string `json:"gate" validate:"required,max=32,charset=loginname"`
+		Scans []struct {
+			Token     string `json:"token"`
+			ScannedAt int64  `json:"scanned_at"`
+		} `json:"scans"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	if len(params.Scans) == 0 || len(params.Scans) > checkinSyncMaxScans {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: []FieldError{{Field: "scans", Code: "out_of_range", Message: "must have 1 to " + strconv.Itoa(checkinSyncMaxScans) + " items"}}}
+	}
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+
+	order := make([]int, len(params.Scans))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return params.Scans[order[a]].ScannedAt < params.Scans[order[b]].ScannedAt
+	})
+
+	results := make([]*checkinSyncResult, len(params.Scans))
+	latest := time.Now().Add(checkinClockSkew).Unix()
+	for _, i := range order {
+		scan := params.Scans[i]
+		result := &checkinSyncResult{Index: i}
+		results[i] = result
+		if scan.ScannedAt <= 0 || scan.ScannedAt > latest {
+			result.Status = "invalid_scanned_at"
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		scannedAt := time.Unix(scan.ScannedAt, 0)
+		checkin, err := checkInTicket(tx, eventID, scan.Token, params.Gate, scannedAt, administrator.ID, checkinSourceSync)
+		if err != nil {
+			tx.Rollback()
+			derr, ok := err.(*DomainError)
+			if !ok {
+				return err
+			}
+			result.Status = derr.Code
+			result.CheckIn = checkin
+			if checkin != nil && checkin.Gate == params.Gate && checkin.CheckedInAtUnix == scan.ScannedAt {
+				result.Status = "checked_in"
+			}
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		result.Status = "checked_in"
+		result.CheckIn = checkin
+	}
+	return c.JSON(200, echo.Map{"results": results})
+}
+
+func getAttendance(eventID int64) (*Attendance, error) {
+	attendance := &Attendance{Ranks: map[string]*RankAttendance{}, Gates: map[string]int{}}
+	for _, rank := range []string{"S", "A", "B", "C"} {
+		attendance.Ranks[rank] = &RankAttendance{}
+	}
+
+	rows, err := db.Query("SELECT s.`rank`, COUNT(r.id), COUNT(ci.reservation_id) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id LEFT JOIN checkins ci ON ci.reservation_id = r.id"+
+		" WHERE r.event_id = ? AND r.canceled_at IS NULL GROUP BY s.`rank`", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rank string
+		var ra RankAttendance
+		if err := rows.Scan(&rank, &ra.Reserved, &ra.CheckedIn); err != nil {
+			return nil, err
+		}
+		attendance.Ranks[rank] = &ra
+		attendance.Reserved += ra.Reserved
+		attendance.CheckedIn += ra.CheckedIn
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	gateRows, err := db.Query("SELECT gate, COUNT(*) FROM checkins WHERE event_id = ? GROUP BY gate", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer gateRows.Close()
+	for gateRows.Next() {
+		var gate string
+		var n int
+		if err := gateRows.Scan(&gate, &n); err != nil {
+			return nil, err
+		}
+		attendance.Gates[gate] = n
+	}
+	return attendance, gateRows.Err()
+}
+
+func getAttendanceHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	if _, err := getEvent(eventID, -1); err != nil {
+		return err
+	}
+	attendance, err := getAttendance(eventID)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(200, attendance)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For is believed.
+// Without any, the client address is the peer of the connection.
+var trustedProxies []*net.IPNet
+
+// loadTrustedProxies parses TRUSTED_PROXIES, a comma separated list of
+// addresses or CIDRs such as "10.0.0.0/8,127.0.0.1".
+func loadTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: bad address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %v", err)
+		}
+		proxies = append(proxies, ipnet)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client in canonical form. Unlike
+// c.RealIP it does not believe forwarding headers sent by the client itself:
+// X-Forwarded-For is only read through trusted proxies, from the right, up to
+// the first address that is not a trusted proxy.
+func clientIP(c echo.Context) string {
+	return requestClientIP(c.Request())
+}
+
+func requestClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "unknown"
+	}
+	if isTrustedProxy(ip) {
+		hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+	}
+	return ip.String()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestClientIP(t *testing.T) {
+	proxies, err := loadTrustedProxies("10.0.0.0/8, 127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []*net.IPNet) { trustedProxies = saved }(trustedProxies)
+	trustedProxies = proxies
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		// 信頼していない接続元のヘッダは無視する
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"203.0.113.5:1234", strings.Repeat("1", 200), "203.0.113.5"},
+		{"127.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:1234", "192.0.2.9, 198.51.100.1, 10.1.2.3", "198.51.100.1"},
+		{"127.0.0.1:1234", "garbage", "127.0.0.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := requestClientIP(r); got != tt.want {
+			t.Errorf("requestClientIP(%s, %q) = %s, want %s", tt.remoteAddr, tt.xff, got, tt.want)
+		}
+	}
+
+	if _, err := loadTrustedProxies("10.0.0.0/8,nope"); err == nil {
+		t.Error("loadTrustedProxies accepted a bad address")
+	}
+}
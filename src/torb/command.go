@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runCommand handles `torb <subcommand> ...` invocations instead of starting the web server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "admin":
+		return runAdminCommand(args[1:])
+	}
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+// validateAdministratorPassword applies the password rule of the admin API.
+func validateAdministratorPassword(password string) error {
+	if len(password) < 8 || len(password) > 128 {
+		return errors.New("-password must be 8 to 128 characters")
+	}
+	return nil
+}
+
+// commandError spells out the rejected fields of a validation error, which
+// the API returns as JSON, in terms of the command line flags.
+func commandError(err error) error {
+	derr, ok := err.(*DomainError)
+	if !ok || len(derr.Fields) == 0 {
+		return err
+	}
+	flags := map[string]string{"login_name": "login"}
+	msgs := make([]string, len(derr.Fields))
+	for i, fe := range derr.Fields {
+		name := fe.Field
+		if alias, ok := flags[name]; ok {
+			name = alias
+		}
+		msgs[i] = "-" + name + " " + fe.Message
+	}
+	return errors.New(strings.Join(msgs, ", "))
+}
+
+// runAdminCommand manages administrators from the command line:
+//
+//	torb admin list
+//	torb admin create -login NAME -nickname NICK -password PASS [-role superadmin|admin]
+//	torb admin edit -id ID [-nickname NICK] [-password PASS]
+//	torb admin role -id ID -role superadmin|admin
+//	torb admin deactivate -id ID
+//	torb admin activate -id ID
+func runAdminCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: torb admin list|create|edit|role|deactivate|activate [flags]")
+	}
+
+	fs := flag.NewFlagSet("admin "+args[0], flag.ContinueOnError)
+	id := fs.Int64("id", 0, "administrator id")
+	loginName := fs.String("login", "", "login name")
+	nickname := fs.String("nickname", "", "nickname")
+	password := fs.String("password", "", "password")
+	role := fs.String("role", "", "role (superadmin or admin)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var result interface{}
+	var err error
+	switch args[0] {
+	case "list":
+		result, err = getAdministrators()
+	case "create":
+		if *role == "" {
+			*role = roleAdmin
+		}
+		result, err = createAdministrator(nil, *loginName, *nickname, *password, *role)
+	case "edit":
+		if *password != "" {
+			if err := validateAdministratorPassword(*password); err != nil {
+				return err
+			}
+		}
+		result, err = updateAdministrator(nil, *id, *nickname, *password)
+	case "role", "deactivate", "activate":
+		var current *Administrator
+		if current, err = getAdministrator(*id); err != nil {
+			return err
+		}
+		switch args[0] {
+		case "role":
+			result, err = changeAdministrator(nil, "administrator.role", *id, *role, current.ActiveFg)
+		case "deactivate":
+			result, err = changeAdministrator(nil, "administrator.deactivate", *id, current.Role, false)
+		case "activate":
+			result, err = changeAdministrator(nil, "administrator.activate", *id, current.Role, true)
+		}
+	default:
+		return fmt.Errorf("unknown admin command: %s", args[0])
+	}
+	if err != nil {
+		return commandError(err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
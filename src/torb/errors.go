@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// ErrorKind classifies domain errors. The kind decides the HTTP status, the code
+// is what clients see in the "error" field.
+type ErrorKind string
+
+const (
+	KindValidation      ErrorKind = "validation"
+	KindUnauthorized    ErrorKind = "unauthorized"
+	KindForbidden       ErrorKind = "forbidden"
+	KindNotFound        ErrorKind = "not_found"
+	KindConflict        ErrorKind = "conflict"
+	KindSoldOut         ErrorKind = "sold_out"
+	KindLimitExceeded   ErrorKind = "limit_exceeded"
+	KindTooManyRequests ErrorKind = "too_many_requests"
+
+	KindPayloadTooLarge      ErrorKind = "payload_too_large"
+	KindUnsupportedMediaType ErrorKind = "unsupported_media_type"
+	KindServiceUnavailable   ErrorKind = "service_unavailable"
+)
+
+var errorKindStatus = map[ErrorKind]int{
+	KindValidation:      400,
+	KindUnauthorized:    401,
+	KindForbidden:       403,
+	KindNotFound:        404,
+	KindConflict:        409,
+	KindSoldOut:         409,
+	KindLimitExceeded:   409,
+	KindTooManyRequests: 429,
+
+	KindPayloadTooLarge:      413,
+	KindUnsupportedMediaType: 415,
+	KindServiceUnavailable:   503,
+}
+
+// DomainError is an expected failure that is reported to the client as is.
+type DomainError struct {
+	Kind   ErrorKind
+	Code   string
+	Fields []FieldError
+}
+
+func (e *DomainError) Error() string {
+	return e.Code
+}
+
+func (e *DomainError) Status() int {
+	if status, ok := errorKindStatus[e.Kind]; ok {
+		return status
+	}
+	return 500
+}
+
+func validationError(code string) *DomainError {
+	return &DomainError{Kind: KindValidation, Code: code}
+}
+
+func unauthorizedError(code string) *DomainError {
+	return &DomainError{Kind: KindUnauthorized, Code: code}
+}
+
+func forbiddenError(code string) *DomainError {
+	return &DomainError{Kind: KindForbidden, Code: code}
+}
+
+func notFoundError(code string) *DomainError {
+	return &DomainError{Kind: KindNotFound, Code: code}
+}
+
+func conflictError(code string) *DomainError {
+	return &DomainError{Kind: KindConflict, Code: code}
+}
+
+func soldOutError() *DomainError {
+	return &DomainError{Kind: KindSoldOut, Code: "sold_out"}
+}
+
+func limitExceededError() *DomainError {
+	return &DomainError{Kind: KindLimitExceeded, Code: "limit_exceeded"}
+}
+
+func tooManyRequestsError(code string) *DomainError {
+	return &DomainError{Kind: KindTooManyRequests, Code: code}
+}
+
+func payloadTooLargeError(code string) *DomainError {
+	return &DomainError{Kind: KindPayloadTooLarge, Code: code}
+}
+
+func unsupportedMediaTypeError(code string) *DomainError {
+	return &DomainError{Kind: KindUnsupportedMediaType, Code: code}
+}
+
+func serviceUnavailableError(code string) *DomainError {
+	return &DomainError{Kind: KindServiceUnavailable, Code: code}
+}
+
+// httpErrorHandler renders every error returned from handlers and middlewares.
+// Domain errors are returned as {"error": code}; anything unexpected is logged
+// with the request id and answered with a generic internal_error so that SQL or
+// other internals never reach the client.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		err = notFoundError("not_found")
+	}
+
+	switch e := err.(type) {
+	case *DomainError:
+		if e.Fields != nil {
+			c.JSON(e.Status(), echo.Map{"error": e.Code, "fields": e.Fields})
+			return
+		}
+		resError(c, e.Code, e.Status())
+		return
+	case *echo.HTTPError:
+		if e.Code < 500 {
+			resError(c, strings.Replace(strings.ToLower(http.StatusText(e.Code)), " ", "_", -1), e.Code)
+			return
+		}
+	}
+
+	requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+	log.Printf("internal error request_id=%s method=%s path=%s: %v", requestID, c.Request().Method, c.Request().URL.Path, err)
+	c.JSON(500, echo.Map{"error": "internal_error", "request_id": requestID})
+}
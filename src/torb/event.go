@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"strings"
+	"time"
 )
 
 type Event struct {
@@ -11,6 +13,22 @@ type Event struct {
 	ClosedFg bool   `json:"closed,omitempty"`
 	Price    int64  `json:"price,omitempty"`
 
+	StartAt     *time.Time `json:"-"`
+	StartAtUnix int64      `json:"start_at,omitempty"`
+
+	Category        *Category        `json:"category,omitempty"`
+	Organizer       string           `json:"organizer,omitempty"`
+	Tags            []string         `json:"tags,omitempty"`
+	Description     string           `json:"description,omitempty"`
+	DescriptionHTML string           `json:"description_html,omitempty"`
+	Performers      []EventPerformer `json:"performers,omitempty"`
+	Images          []EventImage     `json:"images,omitempty"`
+	Limits          *PurchaseLimits  `json:"limits,omitempty"`
+	Sale            *SaleStatus      `json:"sale,omitempty"`
+	Attendance      *Attendance      `json:"attendance,omitempty"`
+	Transfers       *TransferPolicy  `json:"transfers,omitempty"`
+	Resale          *ResalePolicy    `json:"resale,omitempty"`
+
 	Total   int                `json:"total"`
 	Remains int                `json:"remains"`
 	Sheets  map[string]*Sheets `json:"sheets,omitempty"`
@@ -23,7 +41,7 @@ func getEvents(all bool) ([]*Event, error) {
 	}
 	defer tx.Commit()
 
-	rows, err := tx.Query("SELECT * FROM events ORDER BY id ASC")
+	rows, err := tx.Query("SELECT " + eventColumns + " FROM " + eventTables + " ORDER BY e.id ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -32,7 +50,7 @@ func getEvents(all bool) ([]*Event, error) {
 	var events []*Event
 	for rows.Next() {
 		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+		if err := scanEvent(rows, &event); err != nil {
 			return nil, err
 		}
 		if !all && !event.PublicFg {
@@ -75,6 +93,14 @@ func getEvents(all bool) ([]*Event, error) {
 		}
 	}
 
+	byID := make(map[int64]*Event, len(events))
+	for _, event := range events {
+		byID[event.ID] = event
+	}
+	if err := attachEventTags(byID); err != nil {
+		return nil, err
+	}
+
 	return events, nil
 }
 
@@ -89,7 +115,7 @@ func getEventByID(events []*Event, id int64) *Event {
 
 func getEvent(eventID, loginUserID int64) (*Event, error) {
 	var event Event
-	if err := db.QueryRow("SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+	if err := scanEvent(db.QueryRow("SELECT "+eventColumns+" FROM "+eventTables+" WHERE e.id = ?", eventID), &event); err != nil {
 		return nil, err
 	}
 	event.Total = 1000
@@ -198,3 +224,74 @@ func assignReservation(event *Event, reservation Reservation) error {
 	event.Sheets[sheet.Rank].Remains--
 	return nil
 }
+
+func newEventSheets(eventPrice int64) map[string]*Sheets {
+	return map[string]*Sheets{
+		"S": &Sheets{Total: 50, Remains: 50, Price: 5000 + eventPrice},
+		"A": &Sheets{Total: 150, Remains: 150, Price: 3000 + eventPrice},
+		"B": &Sheets{Total: 300, Remains: 300, Price: 1000 + eventPrice},
+		"C": &Sheets{Total: 500, Remains: 500, Price: 0 + eventPrice},
+	}
+}
+
+// getEventSummaries loads many events at once with per-rank totals, remains and
+// prices and tags but without the per-sheet detail. It runs three queries
+// regardless of the number of events. Unknown ids are left out of the result.
+func getEventSummaries(eventIDs []int64) (map[int64]*Event, error) {
+	events := make(map[int64]*Event, len(eventIDs))
+	if len(eventIDs) == 0 {
+		return events, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(eventIDs)), ",")
+	args := make([]interface{}, len(eventIDs))
+	for i, id := range eventIDs {
+		args[i] = id
+	}
+
+	rows, err := db.Query("SELECT "+eventColumns+" FROM "+eventTables+" WHERE e.id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event Event
+		if err := scanEvent(rows, &event); err != nil {
+			return nil, err
+		}
+		event.Total = 1000
+		event.Remains = 1000
+		event.Sheets = newEventSheets(event.Price)
+		events[event.ID] = &event
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT r.event_id, s.`rank`, COUNT(*) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.event_id IN ("+placeholders+") AND r.canceled_at IS NULL GROUP BY r.event_id, s.`rank`", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventID int64
+		var rank string
+		var reserved int
+		if err := rows.Scan(&eventID, &rank, &reserved); err != nil {
+			return nil, err
+		}
+		event, ok := events[eventID]
+		if !ok || event.Sheets[rank] == nil {
+			continue
+		}
+		event.Sheets[rank].Remains -= reserved
+		event.Remains -= reserved
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := attachEventTags(events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
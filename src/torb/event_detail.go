@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	eventMaxTags       = 10
+	eventMaxPerformers = 20
+	eventMaxImages     = 10
+)
+
+type Category struct {
+	ID   int64  `json:"id"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+type EventPerformer struct {
+	Name string `json:"name" validate:"required,max=128,charset=printable"`
+	Role string `json:"role" validate:"max=64,charset=printable"`
+}
+
+// EventImage is either an uploaded image (ImageID, URLs are filled in on save)
+// or an external image given by URL.
+type EventImage struct {
+	ImageID      int64  `json:"image_id,omitempty"`
+	URL          string `json:"url" validate:"max=512,charset=printable"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Alt          string `json:"alt" validate:"max=128,charset=printable"`
+}
+
+// eventColumns and eventTables are shared by every query that loads Event rows
+// so that the category and organizer come along with the basic columns.
+const (
+	eventColumns = "e.id, e.title, e.public_fg, e.closed_fg, e.price, e.start_at, e.organizer, c.id, c.slug, c.name"
+	eventTables  = "events e LEFT JOIN categories c ON c.id = e.category_id"
+)
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(row rowScanner, event *Event) error {
+	var categoryID sql.NullInt64
+	var categorySlug, categoryName sql.NullString
+	if err := row.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.StartAt, &event.Organizer, &categoryID, &categorySlug, &categoryName); err != nil {
+		return err
+	}
+	if event.StartAt != nil {
+		event.StartAtUnix = event.StartAt.Unix()
+	}
+	if categoryID.Valid {
+		event.Category = &Category{ID: categoryID.Int64, Slug: categorySlug.String, Name: categoryName.String}
+	}
+	return nil
+}
+
+// attachEventTags fills Tags of the events with one query.
+func attachEventTags(events map[int64]*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(events))
+	for id := range events {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+
+	rows, err := db.Query("SELECT event_id, tag FROM event_tags WHERE event_id IN ("+placeholders+") ORDER BY event_id, tag", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventID int64
+		var tag string
+		if err := rows.Scan(&eventID, &tag); err != nil {
+			return err
+		}
+		if event, ok := events[eventID]; ok {
+			event.Tags = append(event.Tags, tag)
+		}
+	}
+	return rows.Err()
+}
+
+// attachEventDetails loads what is only shown on the event page: the description
+// (as Markdown and sanitized HTML), tags, performers, images and purchase limits.
+func attachEventDetails(event *Event) error {
+	var description sql.NullString
+	if err := db.QueryRow("SELECT description FROM events WHERE id = ?", event.ID).Scan(&description); err != nil {
+		return err
+	}
+	event.Description = description.String
+	if event.Description != "" {
+		event.DescriptionHTML = renderMarkdown(event.Description)
+	}
+
+	event.Tags = nil
+	if err := attachEventTags(map[int64]*Event{event.ID: event}); err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT name, role FROM event_performers WHERE event_id = ? ORDER BY position", event.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	event.Performers = nil
+	for rows.Next() {
+		var performer EventPerformer
+		if err := rows.Scan(&performer.Name, &performer.Role); err != nil {
+			return err
+		}
+		event.Performers = append(event.Performers, performer)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT image_id, url, thumbnail_url, alt FROM event_images WHERE event_id = ? ORDER BY position", event.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	event.Images = nil
+	for rows.Next() {
+		var image EventImage
+		var imageID sql.NullInt64
+		if err := rows.Scan(&imageID, &image.URL, &image.ThumbnailURL, &image.Alt); err != nil {
+			return err
+		}
+		image.ImageID = imageID.Int64
+		event.Images = append(event.Images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	limits, err := getPurchaseLimits(db, event.ID)
+	if err != nil {
+		return err
+	}
+	event.Limits = nil
+	if !limits.empty() {
+		event.Limits = limits
+	}
+	return nil
+}
+
+// eventDetailsParams is the editable, descriptive part of an event. Saving it
+// replaces all previous details; Category is a category slug ("" for none).
+type eventDetailsParams struct {
+	Category    string           `json:"category" validate:"max=32,charset=loginname"`
+	Organizer   string           `json:"organizer" validate:"max=128,charset=printable"`
+	Description string           `json:"description" validate:"max=10000"`
+	Tags        []string         `json:"tags"`
+	Performers  []EventPerformer `json:"performers"`
+	Images      []EventImage     `json:"images"`
+}
+
+func eventDetailsOf(event *Event) *eventDetailsParams {
+	p := &eventDetailsParams{
+		Organizer:   event.Organizer,
+		Description: event.Description,
+		Tags:        event.Tags,
+		Performers:  event.Performers,
+		Images:      event.Images,
+	}
+	if event.Category != nil {
+		p.Category = event.Category.Slug
+	}
+	return p
+}
+
+// normalizeTag lowercases and trims a tag so that "Rock " and "rock" are the same.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// validate checks the details like structValidator does, including every tag,
+// performer and image, and normalizes the tags. Field names of list elements
+// are reported as e.g. "performers[1].name".
+func (p *eventDetailsParams) validate() error {
+	var fields []FieldError
+	if err := (structValidator{}).Validate(p); err != nil {
+		fields = append(fields, err.(*DomainError).Fields...)
+	}
+
+	tags := make([]string, 0, len(p.Tags))
+	for i, tag := range p.Tags {
+		tag = normalizeTag(tag)
+		if fe := validateField("tags["+strconv.Itoa(i)+"]", reflect.ValueOf(tag), []string{"required", "max=32", "charset=printable"}); fe != nil {
+			fields = append(fields, *fe)
+			continue
+		}
+		if !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	p.Tags = tags
+
+	limits := []struct {
+		name  string
+		n     int
+		limit int
+	}{
+		{"tags", len(p.Tags), eventMaxTags},
+		{"performers", len(p.Performers), eventMaxPerformers},
+		{"images", len(p.Images), eventMaxImages},
+	}
+	for _, l := range limits {
+		if l.n > l.limit {
+			fields = append(fields, FieldError{Field: l.name, Code: "too_large", Message: fmt.Sprintf("must have at most %d items", l.limit)})
+		}
+	}
+
+	for i := range p.Performers {
+		fields = append(fields, validateElement(fmt.Sprintf("performers[%d]", i), &p.Performers[i])...)
+	}
+	for i := range p.Images {
+		fields = append(fields, validateElement(fmt.Sprintf("images[%d]", i), &p.Images[i])...)
+		url := p.Images[i].URL
+		switch {
+		case p.Images[i].ImageID != 0:
+		case url == "":
+			fields = append(fields, FieldError{Field: fmt.Sprintf("images[%d].url", i), Code: "required", Message: "is required without image_id"})
+		case strings.HasPrefix(strings.ToLower(url), "mailto:") || !isSafeLinkURL(url):
+			fields = append(fields, FieldError{Field: fmt.Sprintf("images[%d].url", i), Code: "invalid_format", Message: "must be an http(s) or site-relative url"})
+		}
+	}
+
+	if fields != nil {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+	return nil
+}
+
+func validateElement(prefix string, v interface{}) []FieldError {
+	err := (structValidator{}).Validate(v)
+	if err == nil {
+		return nil
+	}
+	fields := err.(*DomainError).Fields
+	for i := range fields {
+		fields[i].Field = prefix + "." + fields[i].Field
+	}
+	return fields
+}
+
+// saveEventDetails replaces the details of the event within tx.
+func saveEventDetails(tx *sql.Tx, eventID int64, p *eventDetailsParams) error {
+	var categoryID *int64
+	if p.Category != "" {
+		var id int64
+		if err := tx.QueryRow("SELECT id FROM categories WHERE slug = ?", p.Category).Scan(&id); err != nil {
+			if err == sql.ErrNoRows {
+				return validationError("invalid_category")
+			}
+			return err
+		}
+		categoryID = &id
+	}
+
+	if _, err := tx.Exec("UPDATE events SET category_id = ?, organizer = ?, description = ? WHERE id = ?", categoryID, p.Organizer, p.Description, eventID); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"event_tags", "event_performers", "event_images"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE event_id = ?", eventID); err != nil {
+			return err
+		}
+	}
+	for _, tag := range p.Tags {
+		if _, err := tx.Exec("INSERT INTO event_tags (event_id, tag) VALUES (?, ?)", eventID, tag); err != nil {
+			return err
+		}
+	}
+	for i, performer := range p.Performers {
+		if _, err := tx.Exec("INSERT INTO event_performers (event_id, position, name, role) VALUES (?, ?, ?, ?)", eventID, i+1, performer.Name, performer.Role); err != nil {
+			return err
+		}
+	}
+	for i := range p.Images {
+		image := &p.Images[i]
+		var imageID *int64
+		if image.ImageID != 0 {
+			uploaded, err := getImage(tx, image.ImageID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return validationError("invalid_image")
+				}
+				return err
+			}
+			imageID = &uploaded.ID
+			image.URL, image.ThumbnailURL = uploaded.HeroURL, uploaded.ThumbnailURL
+		} else {
+			image.ThumbnailURL = ""
+		}
+		if _, err := tx.Exec("INSERT INTO event_images (event_id, position, image_id, url, thumbnail_url, alt) VALUES (?, ?, ?, ?, ?, ?)", eventID, i+1, imageID, image.URL, image.ThumbnailURL, image.Alt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func editEventDetailsHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+
+	var params eventDetailsParams
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	if err := params.validate(); err != nil {
+		return err
+	}
+
+	event, err := getEvent(eventID, -1)
+	if err != nil {
+		return err
+	}
+	if err := attachEventDetails(event); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := saveEventDetails(tx, event.ID, &params); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "event.edit_details", "event", event.ID, eventDetailsOf(event), &params); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	event, err = getEvent(eventID, -1)
+	if err != nil {
+		return err
+	}
+	if err := attachEventDetails(event); err != nil {
+		return err
+	}
+	return c.JSON(200, event)
+}
+
+func getCategories() ([]*Category, error) {
+	rows, err := db.Query("SELECT id, slug, name FROM categories ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	categories := []*Category{}
+	for rows.Next() {
+		var category Category
+		if err := rows.Scan(&category.ID, &category.Slug, &category.Name); err != nil {
+			return nil, err
+		}
+		categories = append(categories, &category)
+	}
+	return categories, rows.Err()
+}
+
+func getCategoriesHandler(c echo.Context) error {
+	categories, err := getCategories()
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, categories)
+}
+
+func postCategoriesHandler(c echo.Context) error {
+	var params struct {
+		Slug string `json:"slug" validate:"required,max=32,charset=loginname"`
+		Name string `json:"name" validate:"required,max=64,charset=printable"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM categories WHERE slug = ?", params.Slug).Scan(&id); err != sql.ErrNoRows {
+		tx.Rollback()
+		if err == nil {
+			return conflictError("duplicated")
+		}
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO categories (slug, name) VALUES (?, ?)", params.Slug, params.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	categoryID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	category := &Category{ID: categoryID, Slug: params.Slug, Name: params.Name}
+	if err := writeAuditLog(tx, c, "category.create", "category", categoryID, nil, category); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(201, category)
+}
+
+func editCategoryHandler(c echo.Context) error {
+	categoryID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("category_not_found")
+	}
+	var params struct {
+		Name string `json:"name" validate:"required,max=64,charset=printable"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var category Category
+	if err := tx.QueryRow("SELECT id, slug, name FROM categories WHERE id = ? FOR UPDATE", categoryID).Scan(&category.ID, &category.Slug, &category.Name); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("category_not_found")
+		}
+		return err
+	}
+	before := category
+	category.Name = params.Name
+	if _, err := tx.Exec("UPDATE categories SET name = ? WHERE id = ?", category.Name, category.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "category.edit", "category", category.ID, before, category); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, category)
+}
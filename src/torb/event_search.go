@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const eventSearchMaxLimit = 100
+
+// eventSortColumns are the SQL expressions of the sort keys. Events without
+// start_at sort as the unix epoch, and remains is counted from the active
+// reservations like getEventSummaries does.
+var eventSortColumns = map[string]string{
+	"id":       "e.id",
+	"price":    "e.price",
+	"start_at": "IFNULL(e.start_at, '1970-01-01 00:00:00')",
+	"remains":  "((SELECT COUNT(*) FROM sheets) - (SELECT COUNT(*) FROM reservations r WHERE r.event_id = e.id AND r.canceled_at IS NULL))",
+}
+
+var eventSortKeys = map[string]func(e *Event) int64{
+	"id":       func(e *Event) int64 { return e.ID },
+	"price":    func(e *Event) int64 { return e.Price },
+	"start_at": func(e *Event) int64 { return e.StartAtUnix },
+	"remains":  func(e *Event) int64 { return int64(e.Remains) },
+}
+
+// eventQuery holds the search conditions of the event list.
+type eventQuery struct {
+	Title         string
+	Category      string
+	Tags          []string
+	AvailableRank string
+	MinPrice      *int64
+	MaxPrice      *int64
+	Since         *time.Time
+	Until         *time.Time
+
+	SortKey string
+	Desc    bool
+
+	// Cursor is the sort value and id of the last event of the previous page.
+	Cursor *[2]int64
+	Limit  int
+}
+
+func encodeEventCursor(sortKey string, value, id int64) string {
+	raw := sortKey + ":" + strconv.FormatInt(value, 10) + ":" + strconv.FormatInt(id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeEventCursor(sortKey, s string) (*[2]int64, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || parts[0] != sortKey {
+		return nil, false
+	}
+	value, err1 := strconv.ParseInt(parts[1], 10, 64)
+	id, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, false
+	}
+	return &[2]int64{value, id}, true
+}
+
+// parseEventQuery reads the query parameters of GET /api/events and /:
+//
+//	q               title contains (case insensitive)
+//	category        category slug
+//	tag             has the tag; repeat to require several tags
+//	available_rank  only events with remaining seats in the rank
+//	min_price       base price at least
+//	max_price       base price at most
+//	since, until    start_at range (unix time, until is exclusive)
+//	sort            id | price | start_at | remains, prefix "-" for descending
+//	cursor          next cursor of the previous page
+//	limit           page size (max 100). Without it every matching event is returned.
+func parseEventQuery(c echo.Context) (*eventQuery, error) {
+	q := &eventQuery{
+		Title:   strings.TrimSpace(c.QueryParam("q")),
+		SortKey: "id",
+	}
+
+	q.Category = c.QueryParam("category")
+	for _, tag := range c.QueryParams()["tag"] {
+		if tag = normalizeTag(tag); tag != "" && !containsString(q.Tags, tag) {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	if len(q.Tags) > eventMaxTags {
+		return nil, validationError("invalid_tag")
+	}
+	if rank := c.QueryParam("available_rank"); rank != "" {
+		if !validateRank(rank) {
+			return nil, validationError("invalid_rank")
+		}
+		q.AvailableRank = rank
+	}
+	for _, key := range []string{"min_price", "max_price"} {
+		v := c.QueryParam(key)
+		if v == "" {
+			continue
+		}
+		price, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || price < 0 {
+			return nil, validationError("invalid_" + key)
+		}
+		if key == "min_price" {
+			q.MinPrice = &price
+		} else {
+			q.MaxPrice = &price
+		}
+	}
+	for _, key := range []string{"since", "until"} {
+		v := c.QueryParam(key)
+		if v == "" {
+			continue
+		}
+		unix, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, validationError("invalid_" + key)
+		}
+		t := time.Unix(unix, 0).UTC()
+		if key == "since" {
+			q.Since = &t
+		} else {
+			q.Until = &t
+		}
+	}
+
+	if s := c.QueryParam("sort"); s != "" {
+		q.Desc = strings.HasPrefix(s, "-")
+		q.SortKey = strings.TrimPrefix(s, "-")
+		if _, ok := eventSortKeys[q.SortKey]; !ok {
+			return nil, validationError("invalid_sort")
+		}
+	}
+	if s := c.QueryParam("cursor"); s != "" {
+		cursor, ok := decodeEventCursor(q.SortKey, s)
+		if !ok {
+			return nil, validationError("invalid_cursor")
+		}
+		q.Cursor = cursor
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > eventSearchMaxLimit {
+			return nil, validationError("invalid_limit")
+		}
+		q.Limit = limit
+	} else if q.Cursor != nil {
+		q.Limit = eventSearchMaxLimit
+	}
+	return q, nil
+}
+
+// searchEvents returns one page of events matching q, the number of all matching
+// events and the cursor of the next page ("" on the last page). Like getEvents,
+// non-public events are only included when all is true.
+// Filtering, ordering and the keyset cursor are all done in SQL, ties broken by id.
+func searchEvents(q *eventQuery, all bool) ([]*Event, int, string, error) {
+	conds := []string{"1 = 1"}
+	if !all {
+		conds = append(conds, "e.public_fg = 1")
+	}
+	var args []interface{}
+	if q.Title != "" {
+		r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		conds = append(conds, "e.title LIKE ?")
+		args = append(args, "%"+r.Replace(q.Title)+"%")
+	}
+	if q.Category != "" {
+		conds = append(conds, "e.category_id = (SELECT id FROM categories WHERE slug = ?)")
+		args = append(args, q.Category)
+	}
+	for _, tag := range q.Tags {
+		conds = append(conds, "e.id IN (SELECT event_id FROM event_tags WHERE tag = ?)")
+		args = append(args, tag)
+	}
+	if q.AvailableRank != "" {
+		conds = append(conds, "(SELECT COUNT(*) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.event_id = e.id AND r.canceled_at IS NULL AND s.`rank` = ?) < (SELECT COUNT(*) FROM sheets WHERE `rank` = ?)")
+		args = append(args, q.AvailableRank, q.AvailableRank)
+	}
+	if q.MinPrice != nil {
+		conds = append(conds, "e.price >= ?")
+		args = append(args, *q.MinPrice)
+	}
+	if q.MaxPrice != nil {
+		conds = append(conds, "e.price <= ?")
+		args = append(args, *q.MaxPrice)
+	}
+	if q.Since != nil {
+		conds = append(conds, "e.start_at >= ?")
+		args = append(args, *q.Since)
+	}
+	if q.Until != nil {
+		conds = append(conds, "e.start_at < ?")
+		args = append(args, *q.Until)
+	}
+	where := " FROM events e WHERE " + strings.Join(conds, " AND ")
+
+	var total int
+	if q.Limit > 0 {
+		if err := db.QueryRow("SELECT COUNT(*)"+where, args...).Scan(&total); err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	column := eventSortColumns[q.SortKey]
+	dir, op := "ASC", ">"
+	if q.Desc {
+		dir, op = "DESC", "<"
+	}
+	pageArgs := append([]interface{}{}, args...)
+	if q.Cursor != nil {
+		// 並び順でカーソルより後ろにあるイベントから返す
+		var value interface{} = q.Cursor[0]
+		if q.SortKey == "start_at" {
+			value = time.Unix(q.Cursor[0], 0).UTC()
+		}
+		where += " AND (" + column + " " + op + " ? OR (" + column + " = ? AND e.id " + op + " ?))"
+		pageArgs = append(pageArgs, value, value, q.Cursor[1])
+	}
+	query := "SELECT e.id" + where + " ORDER BY " + column + " " + dir + ", e.id " + dir
+	if q.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(q.Limit+1)
+	}
+
+	rows, err := db.Query(query, pageArgs...)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer rows.Close()
+	var eventIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, 0, "", err
+		}
+		eventIDs = append(eventIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, "", err
+	}
+
+	hasNext := q.Limit > 0 && len(eventIDs) > q.Limit
+	if hasNext {
+		eventIDs = eventIDs[:q.Limit]
+	}
+	summaries, err := getEventSummaries(eventIDs)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	events := make([]*Event, 0, len(eventIDs))
+	for _, id := range eventIDs {
+		if event, ok := summaries[id]; ok {
+			events = append(events, event)
+		}
+	}
+	if q.Limit == 0 {
+		total = len(events)
+	}
+
+	var nextCursor string
+	if hasNext && len(events) > 0 {
+		last := events[len(events)-1]
+		nextCursor = encodeEventCursor(q.SortKey, eventSortKeys[q.SortKey](last), last.ID)
+	}
+	return events, total, nextCursor, nil
+}
+
+// setEventSearchHeaders exposes paging metadata while keeping the response body
+// a plain array for existing clients.
+func setEventSearchHeaders(c echo.Context, total int, nextCursor string) {
+	c.Response().Header().Set("X-Total-Count", strconv.Itoa(total))
+	if nextCursor != "" {
+		c.Response().Header().Set("X-Next-Cursor", nextCursor)
+	}
+}
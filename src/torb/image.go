@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	imageMaxBytes     = 10 << 20
+	imageMaxDimension = 8192
+	imageMaxPixels    = 40000000
+	imageJPEGQuality  = 85
+)
+
+// imageVariants are the sizes generated for every upload. Thumbnails are
+// cropped to fill the box; heroes are only scaled down to fit in it.
+var imageVariants = []struct {
+	Name   string
+	Width  int
+	Height int
+	Crop   bool
+}{
+	{"thumb", 400, 300, true},
+	{"hero", 1600, 900, false},
+}
+
+var imageContentTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "png",
+}
+
+var imageKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}_[a-z]+\.(jpg|png)$`)
+
+type Image struct {
+	ID     int64  `json:"id"`
+	Hash   string `json:"-"`
+	Format string `json:"-"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	ThumbnailURL string `json:"thumbnail_url"`
+	HeroURL      string `json:"hero_url"`
+}
+
+func imageKey(hash, variant, format string) string {
+	return hash + "_" + variant + "." + format
+}
+
+func imageURL(key string) string {
+	return "/images/" + key
+}
+
+func (img *Image) fillURLs() {
+	img.ThumbnailURL = imageURL(imageKey(img.Hash, "thumb", img.Format))
+	img.HeroURL = imageURL(imageKey(img.Hash, "hero", img.Format))
+}
+
+func getImage(q queryRower, imageID int64) (*Image, error) {
+	var img Image
+	if err := q.QueryRow("SELECT id, hash, format, width, height FROM images WHERE id = ?", imageID).Scan(&img.ID, &img.Hash, &img.Format, &img.Width, &img.Height); err != nil {
+		return nil, err
+	}
+	img.fillURLs()
+	return &img, nil
+}
+
+// decodeUploadedImage checks the real content type and the dimensions before
+// decoding so that huge images are rejected without allocating them.
+func decodeUploadedImage(data []byte) (image.Image, string, error) {
+	format, ok := imageContentTypes[http.DetectContentType(data)]
+	if !ok {
+		return nil, "", unsupportedMediaTypeError("unsupported_image_type")
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", validationError("invalid_image")
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > imageMaxDimension || config.Height > imageMaxDimension || config.Width*config.Height > imageMaxPixels {
+		return nil, "", validationError("image_too_large")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", validationError("invalid_image")
+	}
+	return src, format, nil
+}
+
+// toRGBA copies src into an RGBA image whose bounds start at (0, 0).
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// resizeRGBA scales the r part of src to w x h. Each destination pixel is the
+// average of the source pixels it covers (box filter), which is enough for the
+// downscaling done here. RGBA is alpha-premultiplied so plain averaging is right.
+func resizeRGBA(src *image.RGBA, r image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := r.Dx(), r.Dy()
+	for y := 0; y < h; y++ {
+		y0, y1 := r.Min.Y+y*sh/h, r.Min.Y+(y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := r.Min.X+x*sw/w, r.Min.X+(x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					sum[0] += uint64(src.Pix[i])
+					sum[1] += uint64(src.Pix[i+1])
+					sum[2] += uint64(src.Pix[i+2])
+					sum[3] += uint64(src.Pix[i+3])
+					i += 4
+				}
+			}
+			n := uint64((x1 - x0) * (y1 - y0))
+			d := dst.PixOffset(x, y)
+			for k := 0; k < 4; k++ {
+				dst.Pix[d+k] = uint8((sum[k] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// resizeVariant makes one variant of src: crop fills w x h from the center,
+// otherwise the image is scaled down (never up) to fit in w x h.
+func resizeVariant(src *image.RGBA, w, h int, crop bool) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if crop {
+		r := src.Bounds()
+		if sw*h > sh*w {
+			cw := sh * w / h
+			r.Min.X = (sw - cw) / 2
+			r.Max.X = r.Min.X + cw
+		} else {
+			ch := sw * h / w
+			r.Min.Y = (sh - ch) / 2
+			r.Max.Y = r.Min.Y + ch
+		}
+		return resizeRGBA(src, r, w, h)
+	}
+
+	scale := math.Min(1, math.Min(float64(w)/float64(sw), float64(h)/float64(sh)))
+	dw := int(math.Max(1, math.Round(float64(sw)*scale)))
+	dh := int(math.Max(1, math.Round(float64(sh)*scale)))
+	return resizeRGBA(src, src.Bounds(), dw, dh)
+}
+
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "jpg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageJPEGQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// getImageByHash returns the image stored for the content hash.
+func getImageByHash(hash string) (*Image, error) {
+	var imageID int64
+	if err := db.QueryRow("SELECT id FROM images WHERE hash = ?", hash).Scan(&imageID); err != nil {
+		return nil, err
+	}
+	return getImage(db, imageID)
+}
+
+// storeImage validates an upload, records the image and writes every variant
+// to the storage. The same file uploaded twice yields the same image. Files are
+// written only once the row is inserted and removed again if it is not committed.
+func storeImage(c echo.Context, data []byte) (*Image, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if img, err := getImageByHash(hash); err == nil {
+		return img, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	src, format, err := decodeUploadedImage(data)
+	if err != nil {
+		return nil, err
+	}
+	// 再エンコードするので EXIF などのメタデータは保存されない
+	rgba := toRGBA(src)
+	files := make(map[string][]byte, len(imageVariants))
+	for _, variant := range imageVariants {
+		encoded, err := encodeImage(resizeVariant(rgba, variant.Width, variant.Height, variant.Crop), format)
+		if err != nil {
+			return nil, err
+		}
+		files[imageKey(hash, variant.Name, format)] = encoded
+	}
+
+	img := &Image{Hash: hash, Format: format, Width: rgba.Bounds().Dx(), Height: rgba.Bounds().Dy()}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec("INSERT INTO images (hash, format, width, height, administrator_id, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		img.Hash, img.Format, img.Width, img.Height, sessAdministratorID(c), time.Now().UTC())
+	if err != nil {
+		tx.Rollback()
+		// 同じファイルが同時にアップロードされた場合は先に登録された方を返す
+		if isDuplicateKeyError(err) {
+			return getImageByHash(hash)
+		}
+		return nil, err
+	}
+	img.ID, err = res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	img.fillURLs()
+	if err := writeAuditLog(tx, c, "image.upload", "image", img.ID, nil, img); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// 同じハッシュの登録は挿入した行のロックで待たされるので、ロールバック前に消せば他の登録のファイルを消すことはない
+	var written []string
+	removeFiles := func() {
+		for _, key := range written {
+			if err := imageStorage.Delete(key); err != nil {
+				log.Printf("image delete key=%s: %v", key, err)
+			}
+		}
+	}
+	for key, encoded := range files {
+		if err := imageStorage.Put(key, encoded); err != nil {
+			removeFiles()
+			tx.Rollback()
+			return nil, err
+		}
+		written = append(written, key)
+	}
+	if err := tx.Commit(); err != nil {
+		removeFiles()
+		return nil, err
+	}
+	return img, nil
+}
+
+// uploadImageHandler accepts a multipart form with the image in "file" (JPEG,
+// PNG or GIF up to 10MB) and returns the image with its variant urls. Use the
+// id as image_id in the event images to attach it.
+func uploadImageHandler(c echo.Context) error {
+	// multipart のヘッダ分の余裕を持たせる
+	limit := int64(imageMaxBytes + 64<<10)
+	if c.Request().ContentLength > limit {
+		return payloadTooLargeError("file_too_large")
+	}
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, limit)
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return payloadTooLargeError("file_too_large")
+		}
+		return validationError("file_required")
+	}
+	if fh.Size > imageMaxBytes {
+		return payloadTooLargeError("file_too_large")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	img, err := storeImage(c, data)
+	if err != nil {
+		return err
+	}
+	return c.JSON(201, img)
+}
+
+var imageContentTypeByFormat = map[string]string{
+	"jpg": "image/jpeg",
+	"png": "image/png",
+}
+
+// getImageFileHandler serves a stored variant. Keys contain the content hash
+// so the files are immutable and can be cached for a year.
+func getImageFileHandler(c echo.Context) error {
+	key := c.Param("key")
+	if !imageKeyPattern.MatchString(key) {
+		return notFoundError("not_found")
+	}
+	r, err := imageStorage.Open(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notFoundError("not_found")
+		}
+		return err
+	}
+	defer r.Close()
+
+	header := c.Response().Header()
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	header.Set("ETag", fmt.Sprintf("%q", strings.SplitN(key, ".", 2)[0]))
+	header.Set("X-Content-Type-Options", "nosniff")
+	if c.Request().Header.Get("If-None-Match") == header.Get("ETag") {
+		return c.NoContent(304)
+	}
+	return c.Stream(200, imageContentTypeByFormat[key[strings.LastIndex(key, ".")+1:]], r)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageStorage keeps the encoded image files. Keys are content addressed, so a
+// stored file never changes and Put may be called again for an existing key.
+type ImageStorage interface {
+	Put(key string, data []byte) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// localImageStorage stores images as files under dir.
+type localImageStorage struct {
+	dir string
+}
+
+func (s *localImageStorage) Put(key string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	// 書き込み途中のファイルを配信しないように一時ファイルから rename する
+	f, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, key))
+}
+
+func (s *localImageStorage) Open(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, key))
+}
+
+// Delete removes the file of key. A missing file is not an error.
+func (s *localImageStorage) Delete(key string) error {
+	if err := os.Remove(filepath.Join(s.dir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// newImageStorage builds a storage from a spec such as "local:/var/lib/torb/images".
+func newImageStorage(spec string) ImageStorage {
+	switch {
+	case strings.HasPrefix(spec, "local:"):
+		return &localImageStorage{dir: strings.TrimPrefix(spec, "local:")}
+	}
+	return &localImageStorage{dir: "images"}
+}
+
+var imageStorage ImageStorage = &localImageStorage{dir: "images"}
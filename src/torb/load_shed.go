@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	routeGroupPublic = "public"
+	routeGroupAPI    = "api"
+	routeGroupAdmin  = "admin"
+)
+
+// concurrencyConfig limits the requests served at the same time per route
+// group. A request waits up to Wait for a free slot before it is shed.
+type concurrencyConfig struct {
+	Limits     map[string]int
+	Wait       time.Duration
+	RetryAfter time.Duration
+}
+
+var defaultConcurrencyConfig = concurrencyConfig{
+	Wait:       100 * time.Millisecond,
+	RetryAfter: time.Second,
+}
+
+var routeGroups = []string{routeGroupPublic, routeGroupAPI, routeGroupAdmin}
+
+// loadConcurrencyConfig applies the environment to the defaults. Shedding is
+// opt-in: only the groups listed in CONCURRENCY_LIMITS are limited, and with
+// nothing set no request is shed.
+//
+//	CONCURRENCY_LIMITS  e.g. "public=64,api=64,admin=8" (0 disables a group)
+//	CONCURRENCY_WAIT    how long to wait for a slot, e.g. "100ms"
+func loadConcurrencyConfig(getenv func(string) string) (concurrencyConfig, error) {
+	config := concurrencyConfig{
+		Limits:     map[string]int{},
+		Wait:       defaultConcurrencyConfig.Wait,
+		RetryAfter: defaultConcurrencyConfig.RetryAfter,
+	}
+
+	for _, entry := range strings.Split(getenv("CONCURRENCY_LIMITS"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		group := strings.TrimSpace(parts[0])
+		if !containsString(routeGroups, group) || len(parts) != 2 {
+			return config, fmt.Errorf("concurrency limit %q: want group=limit with group public, api or admin", entry)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			return config, fmt.Errorf("concurrency limit %q: bad limit", entry)
+		}
+		config.Limits[group] = limit
+	}
+	if v := getenv("CONCURRENCY_WAIT"); v != "" {
+		wait, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("CONCURRENCY_WAIT: %v", err)
+		}
+		config.Wait = wait
+	}
+	return config, nil
+}
+
+// routeGroup classifies a registered route path.
+func routeGroup(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/admin/"):
+		return routeGroupAdmin
+	case strings.HasPrefix(path, "/api/"):
+		return routeGroupAPI
+	}
+	return routeGroupPublic
+}
+
+// dbPoolSaturated reports whether every connection of a bounded pool is in use,
+// in which case a new request would only queue inside database/sql.
+func dbPoolSaturated() bool {
+	stats := db.Stats()
+	return stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections
+}
+
+// loadSheddingMiddleware serves at most the configured number of requests per
+// route group at once. When no slot frees up within the wait, or the DB pool
+// is saturated, the request is answered with 503 and Retry-After instead of
+// piling up on MySQL. Static files and groups without a limit are not shed.
+func loadSheddingMiddleware(config concurrencyConfig) echo.MiddlewareFunc {
+	slots := map[string]chan struct{}{}
+	for group, limit := range config.Limits {
+		if limit > 0 {
+			slots[group] = make(chan struct{}, limit)
+		}
+	}
+	retryAfter := strconv.Itoa(int(config.RetryAfter / time.Second))
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Path() == "/*" {
+				return next(c)
+			}
+			sem, ok := slots[routeGroup(c.Path())]
+			if !ok {
+				return next(c)
+			}
+
+			select {
+			case sem <- struct{}{}:
+			default:
+				timer := time.NewTimer(config.Wait)
+				select {
+				case sem <- struct{}{}:
+					timer.Stop()
+				case <-timer.C:
+					c.Response().Header().Set("Retry-After", retryAfter)
+					return serviceUnavailableError("overloaded")
+				}
+			}
+			defer func() { <-sem }()
+
+			if dbPoolSaturated() {
+				c.Response().Header().Set("Retry-After", retryAfter)
+				return serviceUnavailableError("overloaded")
+			}
+			return next(c)
+		}
+	}
+}
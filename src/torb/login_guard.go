@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	loginScopeUser  = "user"
+	loginScopeAdmin = "admin"
+	// loginScopeAccessCode throttles guessing of presale access codes, keyed by
+	// user instead of login name.
+	loginScopeAccessCode = "access_code"
+	// loginScopePasswordReset limits reset e-mails per account and per IP. Every
+	// request counts; nothing takes it back.
+	loginScopePasswordReset = "password_reset"
+
+	loginKeyAccount = "account"
+	loginKeyIP      = "ip"
+)
+
+// loginGuardPolicy describes how failed logins are throttled for one kind of key.
+// After DelayAfter failures each further attempt has to wait BaseDelay*2^n (capped
+// at MaxDelay) since the previous failure, and after LockAfter failures the key is
+// locked for LockDuration. Failures older than Window are forgotten.
+type loginGuardPolicy struct {
+	DelayAfter   int
+	LockAfter    int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockDuration time.Duration
+	Window       time.Duration
+}
+
+var loginGuardPolicies = map[string]loginGuardPolicy{
+	loginKeyAccount: {
+		DelayAfter:   3,
+		LockAfter:    10,
+		BaseDelay:    time.Second,
+		MaxDelay:     30 * time.Second,
+		LockDuration: 15 * time.Minute,
+		Window:       15 * time.Minute,
+	},
+	loginKeyIP: {
+		DelayAfter:   20,
+		LockAfter:    100,
+		BaseDelay:    time.Second,
+		MaxDelay:     10 * time.Second,
+		LockDuration: 15 * time.Minute,
+		Window:       15 * time.Minute,
+	},
+}
+
+type LoginLock struct {
+	Scope        string     `json:"scope"`
+	KeyType      string     `json:"key_type"`
+	KeyValue     string     `json:"key_value"`
+	Failures     int        `json:"failures"`
+	LastFailedAt *time.Time `json:"-"`
+	LockedUntil  *time.Time `json:"-"`
+
+	LastFailedAtUnix int64 `json:"last_failed_at"`
+	LockedUntilUnix  int64 `json:"locked_until,omitempty"`
+}
+
+func (p loginGuardPolicy) delay(failures int) time.Duration {
+	if failures < p.DelayAfter {
+		return 0
+	}
+	d := p.BaseDelay << uint(failures-p.DelayAfter)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// loginWait returns how long the caller has to wait before the next attempt and
+// whether that is because of a lockout rather than a progressive delay.
+func loginWait(policy loginGuardPolicy, failures int, lastFailedAt time.Time, lockedUntil *time.Time, now time.Time) (time.Duration, bool) {
+	if lockedUntil != nil && now.Before(*lockedUntil) {
+		return lockedUntil.Sub(now), true
+	}
+	if now.Sub(lastFailedAt) > policy.Window {
+		return 0, false
+	}
+	if wait := lastFailedAt.Add(policy.delay(failures)).Sub(now); wait > 0 {
+		return wait, false
+	}
+	return 0, false
+}
+
+// checkLogin rejects the request with 429 when the account or the client IP is
+// currently delayed or locked. Otherwise it counts the attempt as a failure
+// before the credentials are compared, in the same transaction as the check,
+// so that parallel guesses are throttled one after another; recordLoginSuccess
+// takes it back. It returns (true, nil) if the login may proceed.
+func checkLogin(c echo.Context, scope, loginName string) (bool, error) {
+	now := time.Now().UTC()
+	keys := [][2]string{{loginKeyAccount, loginName}, {loginKeyIP, clientIP(c)}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	failures := make([]int, len(keys))
+	for i, key := range keys {
+		// 無い行をロックするとギャップロックで詰まるので先に作っておく
+		if _, err := tx.Exec("INSERT INTO login_failures (scope, key_type, key_value, failures, last_failed_at) VALUES (?, ?, ?, 0, ?) ON DUPLICATE KEY UPDATE key_value = key_value",
+			scope, key[0], key[1], now); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		var lastFailedAt time.Time
+		var lockedUntil *time.Time
+		if err := tx.QueryRow("SELECT failures, last_failed_at, locked_until FROM login_failures WHERE scope = ? AND key_type = ? AND key_value = ? FOR UPDATE", scope, key[0], key[1]).Scan(&failures[i], &lastFailedAt, &lockedUntil); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		policy := loginGuardPolicies[key[0]]
+		if wait, locked := loginWait(policy, failures[i], lastFailedAt, lockedUntil, now); wait > 0 {
+			tx.Rollback()
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			if locked {
+				return false, tooManyRequestsError("login_locked")
+			}
+			return false, tooManyRequestsError("too_many_attempts")
+		}
+		if now.Sub(lastFailedAt) > policy.Window {
+			failures[i] = 0
+		}
+	}
+
+	for i, key := range keys {
+		if err := countLoginFailure(tx, c, scope, key[0], key[1], failures[i]+1, now); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// countLoginFailure stores the failure count of a locked key and locks it once
+// the policy threshold is reached.
+func countLoginFailure(tx *sql.Tx, c echo.Context, scope, keyType, keyValue string, failures int, now time.Time) error {
+	policy := loginGuardPolicies[keyType]
+	var lockedUntil *time.Time
+	if failures >= policy.LockAfter {
+		t := now.Add(policy.LockDuration)
+		lockedUntil = &t
+	}
+	if _, err := tx.Exec("UPDATE login_failures SET failures = ?, last_failed_at = ?, locked_until = ? WHERE scope = ? AND key_type = ? AND key_value = ?",
+		failures, now, lockedUntil, scope, keyType, keyValue); err != nil {
+		return err
+	}
+	if failures == policy.LockAfter {
+		// 監視で拾えるよう固定のプレフィックスで出力する
+		log.Printf("SECURITY login_lockout scope=%s key_type=%s key=%q failures=%d locked_until=%s ip=%s",
+			scope, keyType, keyValue, failures, lockedUntil.Format(time.RFC3339), clientIP(c))
+		if err := writeAuditLog(tx, c, "login.lockout", "login_"+keyType, 0, nil, echo.Map{"scope": scope, "key": keyValue, "failures": failures, "locked_until": lockedUntil.Unix()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordLoginSuccess clears the failure counter of the account and takes back
+// the attempt checkLogin counted for the IP. The rest of the IP counter is kept
+// so that one valid account cannot be used to reset a spraying attack. c is nil
+// when no attempt was counted for the request.
+func recordLoginSuccess(c echo.Context, scope, loginName string) error {
+	if _, err := db.Exec("DELETE FROM login_failures WHERE scope = ? AND key_type = ? AND key_value = ?", scope, loginKeyAccount, loginName); err != nil {
+		return err
+	}
+	if c == nil {
+		return nil
+	}
+	_, err := db.Exec("UPDATE login_failures SET failures = failures - 1 WHERE scope = ? AND key_type = ? AND key_value = ? AND failures > 0", scope, loginKeyIP, clientIP(c))
+	return err
+}
+
+func getLoginLocksHandler(c echo.Context) error {
+	rows, err := db.Query("SELECT scope, key_type, key_value, failures, last_failed_at, locked_until FROM login_failures WHERE locked_until > ? ORDER BY locked_until DESC", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	locks := make([]*LoginLock, 0)
+	for rows.Next() {
+		var lock LoginLock
+		if err := rows.Scan(&lock.Scope, &lock.KeyType, &lock.KeyValue, &lock.Failures, &lock.LastFailedAt, &lock.LockedUntil); err != nil {
+			return err
+		}
+		lock.LastFailedAtUnix = lock.LastFailedAt.Unix()
+		if lock.LockedUntil != nil {
+			lock.LockedUntilUnix = lock.LockedUntil.Unix()
+		}
+		locks = append(locks, &lock)
+	}
+	return c.JSON(200, locks)
+}
+
+func unlockLoginHandler(c echo.Context) error {
+	var params struct {
+		Scope    string `json:"scope" validate:"required,oneof=user|admin|access_code|password_reset"`
+		KeyType  string `json:"key_type" validate:"required,oneof=account|ip"`
+		KeyValue string `json:"key_value" validate:"required,max=128"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM login_failures WHERE scope = ? AND key_type = ? AND key_value = ?", params.Scope, params.KeyType, params.KeyValue)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		tx.Rollback()
+		return err
+	} else if n == 0 {
+		tx.Rollback()
+		return notFoundError("not_found")
+	}
+	if err := writeAuditLog(tx, c, "login.unlock", "login_"+params.KeyType, 0, echo.Map{"scope": params.Scope, "key": params.KeyValue}, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("SECURITY login_unlock scope=%s key_type=%s key=%q by_admin=%d", params.Scope, params.KeyType, params.KeyValue, sessAdministratorID(c))
+	return c.NoContent(204)
+}
+
+// resLoginFailed responds with authentication_failed. The attempt was already
+// counted by checkLogin.
+func resLoginFailed(c echo.Context, scope, loginName string) error {
+	return unauthorizedError("authentication_failed")
+}
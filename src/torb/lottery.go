@@ -0,0 +1,738 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	lotteryStatusOpen      = "open"
+	lotteryStatusDrawn     = "drawn"
+	lotteryStatusPublished = "published"
+
+	lotteryResultWon  = "won"
+	lotteryResultLost = "lost"
+
+	// lotteryAlgorithm names the draw procedure recorded with every draw. Change
+	// it whenever drawLottery changes so that old draws stay reproducible.
+	lotteryAlgorithm = "v1: entries by id, math/rand Shuffle seeded with seed, all-or-nothing per entry, free sheets by ascending num"
+)
+
+// Lottery is the ballot of an event. Users apply between EntryStartsAt and
+// EntryEndsAt; after the window an admin draws (possibly several times with
+// different seeds) and publishes, which turns the winning seats into
+// reservations. Normal reservation is closed until the lottery is published.
+type Lottery struct {
+	EventID       int64      `json:"event_id"`
+	EntryStartsAt time.Time  `json:"-"`
+	EntryEndsAt   time.Time  `json:"-"`
+	MaxQuantity   int        `json:"max_quantity"`
+	Status        string     `json:"status"`
+	Seed          int64      `json:"seed,string,omitempty"`
+	Algorithm     string     `json:"algorithm,omitempty"`
+	DrawnAt       *time.Time `json:"-"`
+	PublishedAt   *time.Time `json:"-"`
+
+	EntryStartsAtUnix int64 `json:"entry_starts_at"`
+	EntryEndsAtUnix   int64 `json:"entry_ends_at"`
+	DrawnAtUnix       int64 `json:"drawn_at,omitempty"`
+	PublishedAtUnix   int64 `json:"published_at,omitempty"`
+}
+
+type LotteryEntry struct {
+	ID        int64      `json:"id"`
+	EventID   int64      `json:"event_id"`
+	UserID    int64      `json:"user_id,omitempty"`
+	SheetRank string     `json:"sheet_rank"`
+	Quantity  int        `json:"quantity"`
+	Result    string     `json:"result,omitempty"`
+	SheetNums []int64    `json:"sheet_nums,omitempty"`
+	CreatedAt *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+func (l *Lottery) fillUnix() {
+	l.EntryStartsAtUnix = l.EntryStartsAt.Unix()
+	l.EntryEndsAtUnix = l.EntryEndsAt.Unix()
+	if l.DrawnAt != nil {
+		l.DrawnAtUnix = l.DrawnAt.Unix()
+	}
+	if l.PublishedAt != nil {
+		l.PublishedAtUnix = l.PublishedAt.Unix()
+	}
+}
+
+func (l *Lottery) entryOpen(now time.Time) bool {
+	return l.Status == lotteryStatusOpen && !now.Before(l.EntryStartsAt) && now.Before(l.EntryEndsAt)
+}
+
+const lotteryColumns = "event_id, entry_starts_at, entry_ends_at, max_quantity, status, seed, algorithm, drawn_at, published_at"
+
+func scanLottery(row rowScanner) (*Lottery, error) {
+	var lottery Lottery
+	var seed sql.NullInt64
+	if err := row.Scan(&lottery.EventID, &lottery.EntryStartsAt, &lottery.EntryEndsAt, &lottery.MaxQuantity, &lottery.Status, &seed, &lottery.Algorithm, &lottery.DrawnAt, &lottery.PublishedAt); err != nil {
+		return nil, err
+	}
+	lottery.Seed = seed.Int64
+	lottery.fillUnix()
+	return &lottery, nil
+}
+
+func getLottery(q queryRower, eventID int64) (*Lottery, error) {
+	return scanLottery(q.QueryRow("SELECT "+lotteryColumns+" FROM event_lotteries WHERE event_id = ?", eventID))
+}
+
+// checkLotterySale rejects normal reservations while the event has an
+// unpublished lottery.
+func checkLotterySale(eventID int64) error {
+	var status string
+	err := db.QueryRow("SELECT status FROM event_lotteries WHERE event_id = ?", eventID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status != lotteryStatusPublished {
+		return forbiddenError("lottery_in_progress")
+	}
+	return nil
+}
+
+// getLotteryEntries returns the live entries of the event in id order, leaving
+// out users who deleted their account, with
+// the drawn seats when withSeats is set.
+func getLotteryEntries(q queryer, eventID int64, withSeats bool) ([]*LotteryEntry, error) {
+	rows, err := q.Query("SELECT le.id, le.event_id, le.user_id, le.sheet_rank, le.quantity, COALESCE(le.result, ''), le.created_at FROM lottery_entries le INNER JOIN users u ON u.id = le.user_id"+
+		" WHERE le.event_id = ? AND le.canceled_at IS NULL AND u.deleted_at IS NULL ORDER BY le.id", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*LotteryEntry{}
+	byID := map[int64]*LotteryEntry{}
+	for rows.Next() {
+		var entry LotteryEntry
+		if err := rows.Scan(&entry.ID, &entry.EventID, &entry.UserID, &entry.SheetRank, &entry.Quantity, &entry.Result, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entry.CreatedAtUnix = entry.CreatedAt.Unix()
+		entries = append(entries, &entry)
+		byID[entry.ID] = &entry
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !withSeats {
+		return entries, nil
+	}
+
+	rows, err = q.Query("SELECT a.entry_id, s.num FROM lottery_assignments a INNER JOIN sheets s ON s.id = a.sheet_id WHERE a.event_id = ? ORDER BY s.num", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entryID, num int64
+		if err := rows.Scan(&entryID, &num); err != nil {
+			return nil, err
+		}
+		if entry, ok := byID[entryID]; ok {
+			entry.SheetNums = append(entry.SheetNums, num)
+		}
+	}
+	return entries, rows.Err()
+}
+
+// drawLottery runs the draw with seed and stores the result as assignments;
+// no reservation is made until publishLottery. The same entries, free seats
+// and seed always give the same result:
+//
+//  1. entries are ordered by id and shuffled with math/rand seeded by seed
+//  2. in that order each entry wins if enough free sheets of its rank are
+//     left and the seats keep the user within the purchase limits, taking the
+//     lowest numbers; otherwise it loses
+func drawLottery(tx *sql.Tx, eventID, seed int64) ([]*LotteryEntry, error) {
+	entries, err := getLotteryEntries(tx, eventID, false)
+	if err != nil {
+		return nil, err
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	rnd.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+
+	free := map[string][]Sheet{}
+	rows, err := tx.Query("SELECT id, `rank`, num FROM sheets WHERE id NOT IN (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL) ORDER BY `rank`, num", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sheet Sheet
+		if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num); err != nil {
+			return nil, err
+		}
+		free[sheet.Rank] = append(free[sheet.Rank], sheet)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM lottery_assignments WHERE event_id = ?", eventID); err != nil {
+		return nil, err
+	}
+	for order, entry := range entries {
+		entry.Result = lotteryResultLost
+		withinLimits, err := lotteryEntryWithinLimits(tx, entry)
+		if err != nil {
+			return nil, err
+		}
+		if sheets := free[entry.SheetRank]; withinLimits && len(sheets) >= entry.Quantity {
+			entry.Result = lotteryResultWon
+			for _, sheet := range sheets[:entry.Quantity] {
+				if _, err := tx.Exec("INSERT INTO lottery_assignments (event_id, entry_id, sheet_id) VALUES (?, ?, ?)", eventID, entry.ID, sheet.ID); err != nil {
+					return nil, err
+				}
+				entry.SheetNums = append(entry.SheetNums, sheet.Num)
+			}
+			free[entry.SheetRank] = sheets[entry.Quantity:]
+		}
+		if _, err := tx.Exec("UPDATE lottery_entries SET result = ?, draw_order = ? WHERE id = ?", entry.Result, order+1, entry.ID); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// lotteryEntryWithinLimits reports whether the seats of the entry keep the user
+// within the purchase limits of the event, counting the reservations they hold.
+func lotteryEntryWithinLimits(tx *sql.Tx, entry *LotteryEntry) (bool, error) {
+	err := checkPurchaseQuantity(tx, entry.UserID, entry.EventID, entry.SheetRank, entry.Quantity)
+	if derr, ok := err.(*DomainError); ok && derr.Kind == KindLimitExceeded {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func newLotterySeed() (int64, error) {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1), nil
+}
+
+func lotteryEventID(c echo.Context) (int64, error) {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, notFoundError("not_found")
+	}
+	return eventID, nil
+}
+
+// getMyLotteryEntryHandler shows the entry of the logged in user. The result
+// is hidden until the lottery is published.
+func getMyLotteryEntryHandler(c echo.Context) error {
+	eventID, err := lotteryEventID(c)
+	if err != nil {
+		return err
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	lottery, err := getLottery(db, eventID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_not_found")
+		}
+		return err
+	}
+
+	var entry LotteryEntry
+	err = db.QueryRow("SELECT id, event_id, sheet_rank, quantity, COALESCE(result, ''), created_at FROM lottery_entries WHERE event_id = ? AND user_id = ? AND canceled_at IS NULL", eventID, user.ID).
+		Scan(&entry.ID, &entry.EventID, &entry.SheetRank, &entry.Quantity, &entry.Result, &entry.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_entry_not_found")
+		}
+		return err
+	}
+	entry.CreatedAtUnix = entry.CreatedAt.Unix()
+	if lottery.Status != lotteryStatusPublished {
+		entry.Result = ""
+	} else if entry.Result == lotteryResultWon {
+		rows, err := db.Query("SELECT s.num FROM lottery_assignments a INNER JOIN sheets s ON s.id = a.sheet_id WHERE a.entry_id = ? ORDER BY s.num", entry.ID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var num int64
+			if err := rows.Scan(&num); err != nil {
+				return err
+			}
+			entry.SheetNums = append(entry.SheetNums, num)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return c.JSON(200, echo.Map{"lottery": lottery, "entry": &entry})
+}
+
+// applyLotteryHandler creates or replaces the entry of the logged in user
+// during the entry window. Re-applying keeps the original entry time.
+func applyLotteryHandler(c echo.Context) error {
+	eventID, err := lotteryEventID(c)
+	if err != nil {
+		return err
+	}
+	var params struct {
+		Rank     string `json:"sheet_rank" validate:"required,oneof=S|A|B|C"`
+		Quantity int    `json:"quantity" validate:"min=1"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	event, err := getEvent(eventID, -1)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundError("invalid_event")
+		}
+		return err
+	} else if !event.PublicFg {
+		return notFoundError("invalid_event")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	lottery, err := scanLottery(tx.QueryRow("SELECT "+lotteryColumns+" FROM event_lotteries WHERE event_id = ? LOCK IN SHARE MODE", eventID))
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_not_found")
+		}
+		return err
+	}
+	if !lottery.entryOpen(time.Now()) {
+		tx.Rollback()
+		return forbiddenError("lottery_entry_closed")
+	}
+	if params.Quantity > lottery.MaxQuantity {
+		tx.Rollback()
+		return limitExceededError()
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("INSERT INTO lottery_entries (event_id, user_id, sheet_rank, quantity, created_at) VALUES (?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE sheet_rank = VALUES(sheet_rank), quantity = VALUES(quantity), created_at = IF(canceled_at IS NULL, created_at, VALUES(created_at)), canceled_at = NULL",
+		eventID, user.ID, params.Rank, params.Quantity, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var entryID int64
+	if err := tx.QueryRow("SELECT id FROM lottery_entries WHERE event_id = ? AND user_id = ?", eventID, user.ID).Scan(&entryID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "lottery.apply", "lottery_entry", entryID, nil, echo.Map{"event_id": eventID, "sheet_rank": params.Rank, "quantity": params.Quantity}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{"id": entryID, "event_id": eventID, "sheet_rank": params.Rank, "quantity": params.Quantity})
+}
+
+// withdrawLotteryHandler cancels the entry of the logged in user during the window.
+func withdrawLotteryHandler(c echo.Context) error {
+	eventID, err := lotteryEventID(c)
+	if err != nil {
+		return err
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	lottery, err := scanLottery(tx.QueryRow("SELECT "+lotteryColumns+" FROM event_lotteries WHERE event_id = ? LOCK IN SHARE MODE", eventID))
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_not_found")
+		}
+		return err
+	}
+	if !lottery.entryOpen(time.Now()) {
+		tx.Rollback()
+		return forbiddenError("lottery_entry_closed")
+	}
+	var entryID int64
+	if err := tx.QueryRow("SELECT id FROM lottery_entries WHERE event_id = ? AND user_id = ? AND canceled_at IS NULL FOR UPDATE", eventID, user.ID).Scan(&entryID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_entry_not_found")
+		}
+		return err
+	}
+	if _, err := tx.Exec("UPDATE lottery_entries SET canceled_at = ? WHERE id = ?", time.Now().UTC(), entryID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "lottery.withdraw", "lottery_entry", entryID, nil, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
+
+// getLotteryHandler shows the lottery with every entry and, once drawn, the
+// results for review.
+func getLotteryHandler(c echo.Context) error {
+	eventID, err := lotteryEventID(c)
+	if err != nil {
+		return err
+	}
+	lottery, err := getLottery(db, eventID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_not_found")
+		}
+		return err
+	}
+	entries, err := getLotteryEntries(db, eventID, lottery.Status != lotteryStatusOpen)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{"lottery": lottery, "entries": entries})
+}
+
+// editLotteryHandler creates the lottery of an event or changes its window and
+// quantity limit. It cannot be changed once drawn.
+func editLotteryHandler(c echo.Context) error {
+	eventID, err := lotteryEventID(c)
+	if err != nil {
+		return err
+	}
+	var params struct {
+		EntryStartsAt int64 `json:"entry_starts_at" validate:"min=1"`
+		EntryEndsAt   int64 `json:"entry_ends_at" validate:"min=1"`
+		MaxQuantity   int   `json:"max_quantity" validate:"min=1,max=10"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	if params.EntryEndsAt <= params.EntryStartsAt {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: []FieldError{{Field: "entry_ends_at", Code: "out_of_range", Message: "must be after entry_starts_at"}}}
+	}
+	if _, err := getEvent(eventID, -1); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	before, err := scanLottery(tx.QueryRow("SELECT "+lotteryColumns+" FROM event_lotteries WHERE event_id = ? FOR UPDATE", eventID))
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if before != nil && before.Status != lotteryStatusOpen {
+		tx.Rollback()
+		return conflictError("lottery_already_drawn")
+	}
+	startsAt, endsAt := time.Unix(params.EntryStartsAt, 0).UTC(), time.Unix(params.EntryEndsAt, 0).UTC()
+	if _, err := tx.Exec("INSERT INTO event_lotteries (event_id, entry_starts_at, entry_ends_at, max_quantity, status, algorithm) VALUES (?, ?, ?, ?, ?, '')"+
+		" ON DUPLICATE KEY UPDATE entry_starts_at = VALUES(entry_starts_at), entry_ends_at = VALUES(entry_ends_at), max_quantity = VALUES(max_quantity)",
+		eventID, startsAt, endsAt, params.MaxQuantity, lotteryStatusOpen); err != nil {
+		tx.Rollback()
+		return err
+	}
+	lottery, err := getLottery(tx, eventID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var beforeValue interface{}
+	if before != nil {
+		beforeValue = before
+	}
+	if err := writeAuditLog(tx, c, "lottery.edit", "event", eventID, beforeValue, lottery); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, lottery)
+}
+
+// drawLotteryHandler draws after the entry window. The seed may be given to
+// reproduce a draw; otherwise a random one is used. Until published the draw
+// can be repeated.
+func drawLotteryHandler(c echo.Context) error {
+	eventID, err := lotteryEventID(c)
+	if err != nil {
+		return err
+	}
+	var params struct {
+		Seed string `json:"seed" validate:"max=19,charset=digits"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	var seed int64
+	if params.Seed != "" {
+		if seed, err = strconv.ParseInt(params.Seed, 10, 64); err != nil {
+			return validationError("invalid_seed")
+		}
+	} else if seed, err = newLotterySeed(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	lottery, err := scanLottery(tx.QueryRow("SELECT "+lotteryColumns+" FROM event_lotteries WHERE event_id = ? FOR UPDATE", eventID))
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_not_found")
+		}
+		return err
+	}
+	if lottery.Status == lotteryStatusPublished {
+		tx.Rollback()
+		return conflictError("lottery_already_published")
+	}
+	if time.Now().Before(lottery.EntryEndsAt) {
+		tx.Rollback()
+		return conflictError("lottery_entry_not_closed")
+	}
+
+	entries, err := drawLottery(tx, eventID, seed)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE event_lotteries SET status = ?, seed = ?, algorithm = ?, drawn_at = ? WHERE event_id = ?", lotteryStatusDrawn, seed, lotteryAlgorithm, now, eventID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var won []int64
+	for _, entry := range entries {
+		if entry.Result == lotteryResultWon {
+			won = append(won, entry.ID)
+		}
+	}
+	if err := writeAuditLog(tx, c, "lottery.draw", "event", eventID, nil, echo.Map{
+		"seed": strconv.FormatInt(seed, 10), "algorithm": lotteryAlgorithm, "entries": len(entries), "won_entry_ids": won,
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("lottery draw event_id=%d seed=%d algorithm=%q entries=%d won=%d", eventID, seed, lotteryAlgorithm, len(entries), len(won))
+
+	lottery, err = getLottery(db, eventID)
+	if err != nil {
+		return err
+	}
+	entries, err = getLotteryEntries(db, eventID, true)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{"lottery": lottery, "entries": entries})
+}
+
+// publishLotteryHandler turns the drawn seats into reservations and notifies
+// every applicant. Afterwards the remaining seats go on normal sale.
+func publishLotteryHandler(c echo.Context) error {
+	eventID, err := lotteryEventID(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	lottery, err := scanLottery(tx.QueryRow("SELECT "+lotteryColumns+" FROM event_lotteries WHERE event_id = ? FOR UPDATE", eventID))
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("lottery_not_found")
+		}
+		return err
+	}
+	if lottery.Status != lotteryStatusDrawn {
+		tx.Rollback()
+		return conflictError("lottery_not_drawn")
+	}
+
+	// 抽選後に当選者が購入した分も含めて上限を確かめる
+	drawn, err := getLotteryEntries(tx, eventID, false)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, entry := range drawn {
+		if entry.Result != lotteryResultWon {
+			continue
+		}
+		withinLimits, err := lotteryEntryWithinLimits(tx, entry)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if !withinLimits {
+			tx.Rollback()
+			return conflictError("lottery_limit_exceeded")
+		}
+	}
+
+	now := time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at)"+
+		" SELECT a.event_id, a.sheet_id, e.user_id, ? FROM lottery_assignments a INNER JOIN lottery_entries e ON e.id = a.entry_id INNER JOIN users u ON u.id = e.user_id"+
+		" WHERE a.event_id = ? AND e.canceled_at IS NULL AND u.deleted_at IS NULL"+
+		" AND NOT EXISTS (SELECT 1 FROM reservations r WHERE r.event_id = a.event_id AND r.sheet_id = a.sheet_id AND r.canceled_at IS NULL)",
+		now, eventID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	reserved, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var assigned int64
+	// 抽選後に退会した当選者の分は発券せず、一般販売に回す
+	if err := tx.QueryRow("SELECT COUNT(*) FROM lottery_assignments a INNER JOIN lottery_entries e ON e.id = a.entry_id INNER JOIN users u ON u.id = e.user_id"+
+		" WHERE a.event_id = ? AND e.canceled_at IS NULL AND u.deleted_at IS NULL", eventID).Scan(&assigned); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if reserved != assigned {
+		// 抽選後に席が埋まった場合は引き直してもらう
+		tx.Rollback()
+		return conflictError("lottery_seats_taken")
+	}
+	if _, err := tx.Exec("UPDATE event_lotteries SET status = ?, published_at = ? WHERE event_id = ?", lotteryStatusPublished, now, eventID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueLotteryReservationWebhooks(tx, eventID, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "lottery.publish", "event", eventID, nil, echo.Map{"seed": strconv.FormatInt(lottery.Seed, 10), "algorithm": lottery.Algorithm, "reservations": reserved}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	entries, err := getLotteryEntries(tx, eventID, true)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := notifyLotteryResults(tx, eventID, entries); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	lottery, err = getLottery(db, eventID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{"lottery": lottery, "entries": entries})
+}
+
+// enqueueLotteryReservationWebhooks sends reservation.created for every seat
+// issued by publishing, with the same payload as a regular reservation.
+func enqueueLotteryReservationWebhooks(tx *sql.Tx, eventID int64, reservedAt time.Time) error {
+	rows, err := tx.Query("SELECT r.id, r.user_id, s.`rank`, s.num, ev.price + s.price FROM reservations r"+
+		" INNER JOIN lottery_assignments a ON a.event_id = r.event_id AND a.sheet_id = r.sheet_id"+
+		" INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events ev ON ev.id = r.event_id"+
+		" WHERE r.event_id = ? AND r.reserved_at = ? AND r.canceled_at IS NULL ORDER BY r.id", eventID, reservedAt)
+	if err != nil {
+		return err
+	}
+	var payloads []echo.Map
+	for rows.Next() {
+		var reservationID, userID, sheetNum, price int64
+		var sheetRank string
+		if err := rows.Scan(&reservationID, &userID, &sheetRank, &sheetNum, &price); err != nil {
+			rows.Close()
+			return err
+		}
+		payloads = append(payloads, echo.Map{"reservation_id": reservationID, "event_id": eventID, "user_id": userID, "sheet_rank": sheetRank, "sheet_num": sheetNum, "price": price})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		if err := enqueueWebhookEvent(tx, webhookReservationCreated, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyLotteryResults queues the result for every applicant. It runs in the
+// publishing transaction so that results go out exactly when seats are issued.
+func notifyLotteryResults(tx *sql.Tx, eventID int64, entries []*LotteryEntry) error {
+	var title string
+	if err := tx.QueryRow("SELECT title FROM events WHERE id = ?", eventID).Scan(&title); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		nums := make([]string, len(entry.SheetNums))
+		for i, num := range entry.SheetNums {
+			nums[i] = entry.SheetRank + "-" + strconv.FormatInt(num, 10)
+		}
+		if err := enqueueNotification(tx, entry.UserID, notificationLotteryResult, map[string]interface{}{
+			"Title":     title,
+			"Won":       entry.Result == lotteryResultWon,
+			"Seats":     strings.Join(nums, ", "),
+			"SheetRank": entry.SheetRank,
+			"Quantity":  entry.Quantity,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderMarkdown converts the small Markdown subset used in event descriptions to
+// HTML. The source is HTML-escaped before any markup is produced, so raw HTML in
+// the input is always shown as text and the output is safe to embed as is.
+//
+// Supported: paragraphs, "#" headings, "-"/"*" and "1." lists, "> " quotes,
+// ``` fenced code blocks, `code`, **strong**, *emphasis* and [text](url) links
+// with http, https, mailto or site-relative urls.
+func renderMarkdown(src string) string {
+	lines := strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n")
+
+	var b strings.Builder
+	var para []string
+	list := ""
+	inCode := false
+
+	flushPara := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + renderMarkdownInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			b.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+
+	for _, line := range lines {
+		if inCode {
+			if strings.HasPrefix(strings.TrimSpace(line), "```") {
+				b.WriteString("</code></pre>\n")
+				inCode = false
+				continue
+			}
+			b.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flushPara()
+			closeList()
+		case strings.HasPrefix(trimmed, "```"):
+			flushPara()
+			closeList()
+			b.WriteString("<pre><code>")
+			inCode = true
+		case markdownHeading.MatchString(trimmed):
+			flushPara()
+			closeList()
+			m := markdownHeading.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">" + renderMarkdownInline(m[2]) + "</h" + level + ">\n")
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			flushPara()
+			openList("ul")
+			b.WriteString("<li>" + renderMarkdownInline(trimmed[2:]) + "</li>\n")
+		case markdownOrderedItem.MatchString(trimmed):
+			flushPara()
+			openList("ol")
+			b.WriteString("<li>" + renderMarkdownInline(markdownOrderedItem.FindStringSubmatch(trimmed)[1]) + "</li>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flushPara()
+			closeList()
+			b.WriteString("<blockquote>" + renderMarkdownInline(strings.TrimSpace(trimmed[1:])) + "</blockquote>\n")
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	if inCode {
+		b.WriteString("</code></pre>\n")
+	}
+	flushPara()
+	closeList()
+	return b.String()
+}
+
+var (
+	markdownHeading     = regexp.MustCompile(`^(#{1,6})\s+(.+?)\s*#*$`)
+	markdownOrderedItem = regexp.MustCompile(`^\d+\.\s+(.*)$`)
+	markdownLink        = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s*]+)\)`)
+	markdownStrong      = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	markdownEmphasis    = regexp.MustCompile(`\*([^*]+)\*`)
+)
+
+func renderMarkdownInline(s string) string {
+	// `code` の中は強調やリンクとして解釈しない
+	parts := strings.Split(s, "`")
+	var b strings.Builder
+	for i, part := range parts {
+		if i%2 == 1 && i < len(parts)-1 {
+			b.WriteString("<code>" + html.EscapeString(part) + "</code>")
+			continue
+		}
+		if i%2 == 1 {
+			b.WriteString("`")
+		}
+		text := html.EscapeString(part)
+		text = markdownLink.ReplaceAllStringFunc(text, func(m string) string {
+			sub := markdownLink.FindStringSubmatch(m)
+			if !isSafeLinkURL(html.UnescapeString(sub[2])) {
+				return sub[1]
+			}
+			return `<a href="` + sub[2] + `" rel="nofollow noopener noreferrer">` + sub[1] + `</a>`
+		})
+		text = markdownStrong.ReplaceAllString(text, "<strong>$1</strong>")
+		text = markdownEmphasis.ReplaceAllString(text, "<em>$1</em>")
+		b.WriteString(text)
+	}
+	return b.String()
+}
+
+// isSafeLinkURL allows http(s), mailto and site-relative urls. Browsers drop
+// tabs and newlines from urls and read "/\" like "//", so urls with control
+// characters or either prefix could point to another host.
+func isSafeLinkURL(u string) bool {
+	for _, r := range u {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+	lower := strings.ToLower(u)
+	for _, prefix := range []string{"http://", "https://", "mailto:"} {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") && !strings.HasPrefix(u, "/\\")
+}
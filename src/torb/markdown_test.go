@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsSafeLinkURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		safe bool
+	}{
+		{"http://example.com/", true},
+		{"HTTPS://example.com/a?b=c", true},
+		{"mailto:info@example.com", true},
+		{"/events/1", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"vbscript:msgbox(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{" javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{"\x01javascript:alert(1)", false},
+		{"//evil.example.com/", false},
+		{"/\\evil.example.com/", false},
+		{"/\t/evil.example.com/", false},
+		{"/\n/evil.example.com/", false},
+		{"http://example.com/\x7f", false},
+		{"events/1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isSafeLinkURL(tt.url); got != tt.safe {
+			t.Errorf("isSafeLinkURL(%q) = %v, want %v", tt.url, got, tt.safe)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"# Title", "<h1>Title</h1>\n"},
+		{"a **b** *c* `d`", "<p>a <strong>b</strong> <em>c</em> <code>d</code></p>\n"},
+		{"- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"1. a\n2. b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"> q", "<blockquote>q</blockquote>\n"},
+		{"```\n<b>\n```", "<pre><code>&lt;b&gt;\n</code></pre>\n"},
+		{"[site](https://example.com/?a=1&b=2)", `<p><a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener noreferrer">site</a></p>` + "\n"},
+		{"`[x](javascript:alert(1))`", "<p><code>[x](javascript:alert(1))</code></p>\n"},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.src); got != tt.want {
+			t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// None of these may produce markup that runs script or leaves the attribute.
+func TestRenderMarkdownXSS(t *testing.T) {
+	tests := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`[x](javascript:alert(1))`,
+		`[x](JAVASCRIPT:alert(1))`,
+		`[x](&#106;avascript:alert(1))`,
+		`[x](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)`,
+		`[x](/\evil.example.com)`,
+		`[x](//evil.example.com)`,
+		`[x](http://example.com/"onmouseover="alert(1))`,
+		`[<img src=x onerror=alert(1)>](http://example.com/)`,
+		`**<svg onload=alert(1)>**`,
+		"```\n</code></pre><script>alert(1)</script>\n```",
+		"# <script>alert(1)</script>",
+		"- <iframe src=javascript:alert(1)>",
+		"> <a href=javascript:alert(1)>x</a>",
+	}
+	for _, src := range tests {
+		got := renderMarkdown(src)
+		lower := strings.ToLower(got)
+		for _, bad := range []string{"<script", "<img", "<svg", "<iframe", "<a href=javascript", `href="javascript`, `href="data`, `href="/\`, `href="//`, `"onmouseover`} {
+			if strings.Contains(lower, bad) {
+				t.Errorf("renderMarkdown(%q) = %q contains %q", src, got, bad)
+			}
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	notificationChannelEmail   = "email"
+	notificationChannelWebhook = "webhook"
+
+	notificationReservationConfirmed = "reservation_confirmed"
+	notificationReservationCanceled  = "reservation_canceled"
+	notificationEventReminder        = "event_reminder"
+	notificationLotteryResult        = "lottery_result"
+	notificationPasswordReset        = "password_reset"
+	notificationTransferRequested    = "transfer_requested"
+	notificationTransferAccepted     = "transfer_accepted"
+	notificationResaleSold           = "resale_sold"
+	notificationSeatChanged          = "seat_changed"
+
+	notificationStatusPending = "pending"
+	notificationStatusSent    = "sent"
+	notificationStatusFailed  = "failed"
+
+	notificationMaxAttempts = 8
+	notificationBatchSize   = 50
+	// 送信中の行はこの時間だけ他のワーカーから見えなくなる
+	notificationLease = 5 * time.Minute
+	// start_at のこの時間前にリマインドを送る
+	notificationReminderLead = 24 * time.Hour
+)
+
+type notificationKind struct {
+	subject *template.Template
+	body    *template.Template
+	// Mandatory notifications cannot be turned off by the user.
+	Mandatory bool
+}
+
+func mustNotificationKind(subject, body string, mandatory bool) *notificationKind {
+	return &notificationKind{
+		subject:   template.Must(template.New("subject").Parse(subject)),
+		body:      template.Must(template.New("body").Parse(body)),
+		Mandatory: mandatory,
+	}
+}
+
+// notificationKinds holds the templates. Every template gets the data passed to
+// enqueueNotification plus .Nickname of the recipient.
+var notificationKinds = map[string]*notificationKind{
+	notificationReservationConfirmed: mustNotificationKind(
+		"Torb reservation confirmed: {{.Title}}",
+		"{{.Nickname}} さん\n\nYour reservation for {{.Title}} is confirmed.\nSeat: {{.SheetRank}}-{{.SheetNum}}\nReservation ID: {{.ReservationID}}",
+		false),
+	notificationReservationCanceled: mustNotificationKind(
+		"Torb reservation canceled: {{.Title}}",
+		"{{.Nickname}} さん\n\nYour reservation for {{.Title}} (seat {{.SheetRank}}-{{.SheetNum}}) has been canceled.",
+		false),
+	notificationEventReminder: mustNotificationKind(
+		"Torb reminder: {{.Title}} starts soon",
+		"{{.Nickname}} さん\n\n{{.Title}} starts at {{.StartAt}}.\nYour seats: {{.Seats}}",
+		false),
+	notificationLotteryResult: mustNotificationKind(
+		"Torb lottery result: {{.Title}}",
+		"{{.Nickname}} さん\n\n{{if .Won}}Congratulations! You won {{.Title}}. Your seats: {{.Seats}}{{else}}We are sorry, your application for {{.Title}} ({{.SheetRank}} x {{.Quantity}}) was not drawn.{{end}}",
+		true),
+	notificationPasswordReset: mustNotificationKind(
+		"Torb password reset",
+		"Use the following token to reset your password within 30 minutes:\n\n{{.Token}}\n\nIf you did not request a password reset, you can ignore this message.",
+		true),
+	notificationTransferRequested: mustNotificationKind(
+		"Torb ticket transfer: {{.Title}}",
+		"{{.Nickname}} さん\n\n{{.From}} wants to transfer a ticket for {{.Title}} (seat {{.SheetRank}}-{{.SheetNum}}) to you.\nAccept or decline it within 72 hours. Transfer ID: {{.TransferID}}",
+		false),
+	notificationTransferAccepted: mustNotificationKind(
+		"Torb ticket transferred: {{.Title}}",
+		"{{.Nickname}} さん\n\n{{.To}} accepted your ticket for {{.Title}} (seat {{.SheetRank}}-{{.SheetNum}}). The ticket you were issued is no longer valid.",
+		false),
+	notificationResaleSold: mustNotificationKind(
+		"Torb resale sold: {{.Title}}",
+		"{{.Nickname}} さん\n\nYour seat {{.SheetRank}}-{{.SheetNum}} for {{.Title}} was sold for {{.Price}} yen.\nFee: {{.Fee}} yen\nYour proceeds: {{.Proceeds}} yen\nThe ticket you were issued is no longer valid.",
+		false),
+	notificationSeatChanged: mustNotificationKind(
+		"Torb seat changed: {{.Title}}",
+		"{{.Nickname}} さん\n\nYour seat for {{.Title}} has been changed from {{.PreviousSheetRank}}-{{.PreviousSheetNum}} to {{.SheetRank}}-{{.SheetNum}}.\nPrice difference: {{.PriceDifference}} yen\nReservation ID: {{.ReservationID}}\nThe ticket of your previous seat is no longer valid.",
+		false),
+}
+
+// defaultChannelEnabled applies when the user has not set a preference.
+var defaultChannelEnabled = map[string]bool{
+	notificationChannelEmail:   true,
+	notificationChannelWebhook: false,
+}
+
+// notificationDB is satisfied by both *sql.DB and *sql.Tx.
+type notificationDB interface {
+	execer
+	queryer
+	queryRower
+}
+
+type Notification struct {
+	ID            int64      `json:"id"`
+	UserID        int64      `json:"user_id"`
+	Kind          string     `json:"kind"`
+	Channel       string     `json:"channel"`
+	Subject       string     `json:"subject"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"-"`
+	NextAttemptAt time.Time  `json:"-"`
+	SentAt        *time.Time `json:"-"`
+
+	CreatedAtUnix     int64 `json:"created_at"`
+	NextAttemptAtUnix int64 `json:"next_attempt_at,omitempty"`
+	SentAtUnix        int64 `json:"sent_at,omitempty"`
+}
+
+type NotificationPreference struct {
+	Kind      string `json:"kind"`
+	Channel   string `json:"channel"`
+	Enabled   bool   `json:"enabled"`
+	Mandatory bool   `json:"mandatory,omitempty"`
+}
+
+// getNotificationPreferences returns the effective preference of every kind
+// and configured channel for the user.
+func getNotificationPreferences(q queryer, userID int64) ([]*NotificationPreference, error) {
+	rows, err := q.Query("SELECT kind, channel, enabled FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stored := map[string]bool{}
+	for rows.Next() {
+		var kind, channel string
+		var enabled bool
+		if err := rows.Scan(&kind, &channel, &enabled); err != nil {
+			return nil, err
+		}
+		stored[kind+"/"+channel] = enabled
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	kinds := make([]string, 0, len(notificationKinds))
+	for kind := range notificationKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	channels := make([]string, 0, len(notificationChannels))
+	for channel := range notificationChannels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	prefs := []*NotificationPreference{}
+	for _, kind := range kinds {
+		for _, channel := range channels {
+			enabled, ok := stored[kind+"/"+channel]
+			if !ok {
+				enabled = defaultChannelEnabled[channel]
+			}
+			mandatory := notificationKinds[kind].Mandatory && channel == notificationChannelEmail
+			prefs = append(prefs, &NotificationPreference{Kind: kind, Channel: channel, Enabled: enabled || mandatory, Mandatory: mandatory})
+		}
+	}
+	return prefs, nil
+}
+
+// enqueueNotification renders the kind for the user and queues one message per
+// enabled channel. Call it inside the transaction of the change it reports so
+// that the message is sent if and only if the change is committed.
+func enqueueNotification(q notificationDB, userID int64, kind string, data map[string]interface{}) error {
+	k := notificationKinds[kind]
+	var nickname string
+	if err := q.QueryRow("SELECT nickname FROM users WHERE id = ?", userID).Scan(&nickname); err != nil {
+		return err
+	}
+	values := map[string]interface{}{"Nickname": nickname}
+	for key, v := range data {
+		values[key] = v
+	}
+	var subject, body bytes.Buffer
+	if err := k.subject.Execute(&subject, values); err != nil {
+		return err
+	}
+	if err := k.body.Execute(&body, values); err != nil {
+		return err
+	}
+
+	prefs, err := getNotificationPreferences(q, userID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, pref := range prefs {
+		if pref.Kind != kind || !pref.Enabled {
+			continue
+		}
+		if _, err := q.Exec("INSERT INTO notification_outbox (user_id, kind, channel, subject, body, status, attempts, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?)",
+			userID, kind, pref.Channel, subject.String(), body.String(), notificationStatusPending, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryBackoff returns the delay before the next delivery attempt: 30 seconds
+// doubled on every failure, at most an hour.
+func retryBackoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// workerInterval parses the interval of a background worker: a duration such
+// as "5s" (default 5s) or "off".
+func workerInterval(v string) (time.Duration, bool) {
+	if v == "off" {
+		return 0, false
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return interval, true
+}
+
+// runNotificationWorker queues reminders and delivers the outbox every interval.
+// Several instances may run it: a row is claimed with a conditional update
+// before it is sent.
+func runNotificationWorker(interval time.Duration) {
+	for {
+		now := time.Now().UTC()
+		if err := enqueueEventReminders(now); err != nil {
+			log.Println("notification worker: reminders:", err)
+		}
+		if err := deliverNotifications(now); err != nil {
+			log.Println("notification worker: deliver:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func deliverNotifications(now time.Time) error {
+	rows, err := db.Query("SELECT id, attempts FROM notification_outbox WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?", notificationStatusPending, now, notificationBatchSize)
+	if err != nil {
+		return err
+	}
+	type candidate struct {
+		id       int64
+		attempts int
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var cand candidate
+		if err := rows.Scan(&cand.id, &cand.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		candidates = append(candidates, cand)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, cand := range candidates {
+		res, err := db.Exec("UPDATE notification_outbox SET attempts = attempts + 1, next_attempt_at = ? WHERE id = ? AND status = ? AND attempts = ?",
+			now.Add(notificationLease), cand.id, notificationStatusPending, cand.attempts)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// 他のワーカーが先に取った
+			continue
+		}
+		if err := deliverNotification(cand.id, cand.attempts+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverNotification sends a claimed row and records the outcome. It only
+// returns database errors; delivery errors are stored on the row.
+func deliverNotification(id int64, attempts int) error {
+	var kind, channel, subject, body string
+	var user User
+	var email sql.NullString
+	err := db.QueryRow("SELECT o.kind, o.channel, o.subject, o.body, u.id, u.login_name, u.nickname, u.email FROM notification_outbox o INNER JOIN users u ON u.id = o.user_id WHERE o.id = ?", id).
+		Scan(&kind, &channel, &subject, &body, &user.ID, &user.LoginName, &user.Nickname, &email)
+	if err != nil {
+		return err
+	}
+	user.Email = email.String
+
+	sendErr := errNoRecipient
+	if ch, ok := notificationChannels[channel]; ok {
+		sendErr = ch.Notify(&user, subject, body)
+	}
+	now := time.Now().UTC()
+	if sendErr == nil {
+		// パスワードリセットのトークンは送信後に残さない
+		_, err := db.Exec("UPDATE notification_outbox SET status = ?, sent_at = ?, last_error = '', body = IF(kind = ?, '', body) WHERE id = ?", notificationStatusSent, now, notificationPasswordReset, id)
+		return err
+	}
+
+	log.Printf("notification id=%d kind=%s channel=%s attempt=%d: %v", id, kind, channel, attempts, sendErr)
+	lastError := sendErr.Error()
+	if len(lastError) > 255 {
+		lastError = lastError[:255]
+	}
+	status := notificationStatusPending
+	if sendErr == errNoRecipient || attempts >= notificationMaxAttempts {
+		status = notificationStatusFailed
+	}
+	// 諦めたパスワードリセットのトークンも残さない
+	_, err = db.Exec("UPDATE notification_outbox SET status = ?, next_attempt_at = ?, last_error = ?, body = IF(? AND kind = ?, '', body) WHERE id = ?",
+		status, now.Add(retryBackoff(attempts)), lastError, status == notificationStatusFailed, notificationPasswordReset, id)
+	return err
+}
+
+// enqueueEventReminders queues one reminder per user and event starting within
+// notificationReminderLead. notification_reminders remembers who was reminded.
+func enqueueEventReminders(now time.Time) error {
+	rows, err := db.Query("SELECT DISTINCT r.event_id, r.user_id FROM reservations r INNER JOIN events e ON e.id = r.event_id"+
+		" WHERE e.start_at > ? AND e.start_at <= ? AND e.closed_fg = 0 AND r.canceled_at IS NULL"+
+		" AND NOT EXISTS (SELECT 1 FROM notification_reminders n WHERE n.event_id = r.event_id AND n.user_id = r.user_id)",
+		now, now.Add(notificationReminderLead))
+	if err != nil {
+		return err
+	}
+	var targets [][2]int64
+	for rows.Next() {
+		var eventID, userID int64
+		if err := rows.Scan(&eventID, &userID); err != nil {
+			rows.Close()
+			return err
+		}
+		targets = append(targets, [2]int64{eventID, userID})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		if err := enqueueEventReminder(target[0], target[1], now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func enqueueEventReminder(eventID, userID int64, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT IGNORE INTO notification_reminders (event_id, user_id, created_at) VALUES (?, ?, ?)", eventID, userID, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		return err
+	}
+
+	var title string
+	var startAt time.Time
+	if err := tx.QueryRow("SELECT title, start_at FROM events WHERE id = ?", eventID).Scan(&title, &startAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	rows, err := tx.Query("SELECT s.`rank`, s.num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.event_id = ? AND r.user_id = ? AND r.canceled_at IS NULL ORDER BY s.id", eventID, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var seats []string
+	for rows.Next() {
+		var rank string
+		var num int64
+		if err := rows.Scan(&rank, &num); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		seats = append(seats, rank+"-"+strconv.FormatInt(num, 10))
+	}
+	rows.Close()
+
+	if err := enqueueNotification(tx, userID, notificationEventReminder, map[string]interface{}{
+		"Title":   title,
+		"StartAt": startAt.Format("2006-01-02 15:04 MST"),
+		"Seats":   strings.Join(seats, ", "),
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func getNotificationPreferencesHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	prefs, err := getNotificationPreferences(db, loginUser.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, prefs)
+}
+
+// editNotificationPreferencesHandler stores the given preferences. Kinds and
+// channels that are not listed keep their current setting.
+func editNotificationPreferencesHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	var params struct {
+		Preferences []struct {
+			Kind    string `json:"kind"`
+			Channel string `json:"channel"`
+			Enabled bool   `json:"enabled"`
+		} `json:"preferences"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	var fields []FieldError
+	for i, pref := range params.Preferences {
+		field := "preferences[" + strconv.Itoa(i) + "]"
+		if notificationKinds[pref.Kind] == nil {
+			fields = append(fields, FieldError{Field: field + ".kind", Code: "invalid_choice", Message: "is not a notification kind"})
+		}
+		if _, ok := defaultChannelEnabled[pref.Channel]; !ok {
+			fields = append(fields, FieldError{Field: field + ".channel", Code: "invalid_choice", Message: "must be one of email, webhook"})
+		}
+	}
+	if fields != nil {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	before, err := getNotificationPreferences(tx, loginUser.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, pref := range params.Preferences {
+		if _, err := tx.Exec("INSERT INTO notification_preferences (user_id, kind, channel, enabled) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)",
+			loginUser.ID, pref.Kind, pref.Channel, pref.Enabled); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	after, err := getNotificationPreferences(tx, loginUser.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "user.edit_notification_preferences", "user", loginUser.ID, before, after); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, after)
+}
+
+// getNotificationsHandler lists the outbox for operators, newest first.
+// Filters: status, user_id, kind.
+func getNotificationsHandler(c echo.Context) error {
+	query := "SELECT id, user_id, kind, channel, subject, status, attempts, last_error, created_at, next_attempt_at, sent_at FROM notification_outbox WHERE 1 = 1"
+	var args []interface{}
+	if v := c.QueryParam("status"); v != "" {
+		query += " AND status = ?"
+		args = append(args, v)
+	}
+	if v := c.QueryParam("kind"); v != "" {
+		query += " AND kind = ?"
+		args = append(args, v)
+	}
+	if v := c.QueryParam("user_id"); v != "" {
+		userID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return validationError("invalid_user_id")
+		}
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	query += " ORDER BY id DESC LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	notifications := []*Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &n.Channel, &n.Subject, &n.Status, &n.Attempts, &n.LastError, &n.CreatedAt, &n.NextAttemptAt, &n.SentAt); err != nil {
+			return err
+		}
+		n.CreatedAtUnix = n.CreatedAt.Unix()
+		if n.Status == notificationStatusPending {
+			n.NextAttemptAtUnix = n.NextAttemptAt.Unix()
+		}
+		if n.SentAt != nil {
+			n.SentAtUnix = n.SentAt.Unix()
+		}
+		notifications = append(notifications, &n)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, notifications)
+}
+
+// retryNotificationHandler puts a failed message back into the queue. Password
+// resets cannot be retried because their token is gone.
+func retryNotificationHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("notification_not_found")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var status, kind string
+	if err := tx.QueryRow("SELECT status, kind FROM notification_outbox WHERE id = ? FOR UPDATE", id).Scan(&status, &kind); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("notification_not_found")
+		}
+		return err
+	}
+	if status != notificationStatusFailed {
+		tx.Rollback()
+		return conflictError("notification_not_failed")
+	}
+	if kind == notificationPasswordReset {
+		// トークンは失敗時に消しているので、ユーザーに再申請してもらう
+		tx.Rollback()
+		return conflictError("notification_not_retryable")
+	}
+	if _, err := tx.Exec("UPDATE notification_outbox SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ?", notificationStatusPending, time.Now().UTC(), id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "notification.retry", "notification", id, echo.Map{"status": status}, echo.Map{"status": notificationStatusPending}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
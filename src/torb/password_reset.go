@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const passwordResetTokenTTL = 30 * time.Minute
+
+// requestPasswordResetHandler issues a reset token and queues it for the user.
+// It always answers 202 so that it cannot be used to probe accounts, also when
+// the account or the client IP has asked too often.
+func requestPasswordResetHandler(c echo.Context) error {
+	var params struct {
+		LoginName string `json:"login_name" validate:"max=128"`
+		Email     string `json:"email" validate:"max=255,email"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	var user User
+	var email sql.NullString
+	var err error
+	switch {
+	case params.LoginName != "":
+		err = db.QueryRow("SELECT id, login_name, nickname, email FROM users WHERE login_name = ? AND deleted_at IS NULL", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &email)
+	case params.Email != "":
+		err = db.QueryRow("SELECT id, login_name, nickname, email FROM users WHERE email = ? AND deleted_at IS NULL", params.Email).Scan(&user.ID, &user.LoginName, &user.Nickname, &email)
+	default:
+		return validationError("invalid_params")
+	}
+	if err == sql.ErrNoRows {
+		return c.NoContent(202)
+	}
+	if err != nil {
+		return err
+	}
+	user.Email = email.String
+
+	// 制限中も応答を変えず、アカウントの有無や制限の状態を見せない
+	if ok, err := checkLogin(c, loginScopePasswordReset, "user:"+strconv.FormatInt(user.ID, 10)); !ok {
+		if derr, limited := err.(*DomainError); limited && derr.Kind == KindTooManyRequests {
+			c.Response().Header().Del("Retry-After")
+			return c.NoContent(202)
+		}
+		return err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now().UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, created_at) VALUES (?, SHA2(?, 256), ?, ?)", user.ID, token, now.Add(passwordResetTokenTTL), now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	setAuditActor(c, actorUser, user.ID)
+	if err := writeAuditLog(tx, c, "user.password_reset_request", "user", user.ID, nil, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueNotification(tx, user.ID, notificationPasswordReset, map[string]interface{}{"Token": token}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.NoContent(202)
+}
+
+// confirmPasswordResetHandler consumes a token, sets the new password and revokes
+// every existing session of the user.
+func confirmPasswordResetHandler(c echo.Context) error {
+	var params struct {
+		Token    string `json:"token" validate:"required,max=128"`
+		Password string `json:"password" validate:"required,max=128"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var tokenID, userID int64
+	if err := tx.QueryRow("SELECT id, user_id FROM password_reset_tokens WHERE token_hash = SHA2(?, 256) AND used_at IS NULL AND expires_at > ? FOR UPDATE", params.Token, now).Scan(&tokenID, &userID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return validationError("invalid_token")
+		}
+		return err
+	}
+
+	var loginName string
+	if err := tx.QueryRow("SELECT login_name FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE", userID).Scan(&loginName); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return validationError("invalid_token")
+		}
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET pass_hash = SHA2(?, 256), session_version = session_version + 1 WHERE id = ?", params.Password, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// 使用済みのトークンと同じユーザーの未使用トークンをまとめて無効化する
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL", now, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	setAuditActor(c, actorUser, userID)
+	if err := writeAuditLog(tx, c, "user.password_reset", "user", userID, nil, echo.Map{"token_id": tokenID, "sessions_revoked": true}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := recordLoginSuccess(nil, loginScopeUser, loginName); err != nil {
+		return err
+	}
+	sessDeleteUserID(c)
+	return c.NoContent(204)
+}
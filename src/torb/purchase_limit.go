@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// PurchaseLimits caps the active reservations one user may hold for an event.
+// Zero means no limit.
+type PurchaseLimits struct {
+	MaxPerUser int            `json:"max_per_user,omitempty"`
+	MaxPerRank map[string]int `json:"max_per_rank,omitempty"`
+}
+
+func (l *PurchaseLimits) empty() bool {
+	return l.MaxPerUser == 0 && len(l.MaxPerRank) == 0
+}
+
+// getPurchaseLimits loads the limits of the event. The whole-event limit is
+// stored with an empty sheet_rank.
+func getPurchaseLimits(q queryer, eventID int64) (*PurchaseLimits, error) {
+	rows, err := q.Query("SELECT sheet_rank, max_per_user FROM event_purchase_limits WHERE event_id = ?", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := &PurchaseLimits{}
+	for rows.Next() {
+		var rank string
+		var max int
+		if err := rows.Scan(&rank, &max); err != nil {
+			return nil, err
+		}
+		if rank == "" {
+			limits.MaxPerUser = max
+			continue
+		}
+		if limits.MaxPerRank == nil {
+			limits.MaxPerRank = map[string]int{}
+		}
+		limits.MaxPerRank[rank] = max
+	}
+	return limits, rows.Err()
+}
+
+// checkPurchaseLimits fails with limit_exceeded when one more reservation of
+// rank would exceed the limits of the event. It must run in the reserving
+// transaction before the insert: the user row is locked so that concurrent
+// reservations of the same user are counted one after another.
+func checkPurchaseLimits(tx *sql.Tx, userID, eventID int64, rank string) error {
+	return checkPurchaseQuantity(tx, userID, eventID, rank, 1)
+}
+
+// checkPurchaseQuantity is checkPurchaseLimits for n reservations of rank at once.
+func checkPurchaseQuantity(tx *sql.Tx, userID, eventID int64, rank string, n int) error {
+	limits, err := getPurchaseLimits(tx, eventID)
+	if err != nil {
+		return err
+	}
+	if limits.empty() {
+		return nil
+	}
+
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id); err != nil {
+		return err
+	}
+
+	// ロック取得前のスナップショットを読まないようにロック読み取りで数える
+	var total, inRank int
+	if err := tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(s.`rank` = ?), 0) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.event_id = ? AND r.user_id = ? AND r.canceled_at IS NULL LOCK IN SHARE MODE", rank, eventID, userID).Scan(&total, &inRank); err != nil {
+		return err
+	}
+	if limits.MaxPerUser > 0 && total+n > limits.MaxPerUser {
+		return limitExceededError()
+	}
+	if max := limits.MaxPerRank[rank]; max > 0 && inRank+n > max {
+		return limitExceededError()
+	}
+	return nil
+}
+
+// editPurchaseLimitsHandler replaces the limits of an event. Omitted ranks and
+// zero values remove the limit.
+func editPurchaseLimitsHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+
+	var params struct {
+		MaxPerUser int            `json:"max_per_user" validate:"min=0,max=1000"`
+		MaxPerRank map[string]int `json:"max_per_rank"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	var fields []FieldError
+	ranks := make([]string, 0, len(params.MaxPerRank))
+	for rank, max := range params.MaxPerRank {
+		if !validateRank(rank) {
+			fields = append(fields, FieldError{Field: "max_per_rank." + rank, Code: "invalid_choice", Message: "must be one of S, A, B, C"})
+		} else if max < 0 || max > 1000 {
+			fields = append(fields, FieldError{Field: "max_per_rank." + rank, Code: "out_of_range", Message: "must be between 0 and 1000"})
+		}
+		ranks = append(ranks, rank)
+	}
+	if fields != nil {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+	sort.Strings(ranks)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM events WHERE id = ? FOR UPDATE", eventID).Scan(&id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	before, err := getPurchaseLimits(tx, eventID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM event_purchase_limits WHERE event_id = ?", eventID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	limits := &PurchaseLimits{MaxPerUser: params.MaxPerUser}
+	if params.MaxPerUser > 0 {
+		if _, err := tx.Exec("INSERT INTO event_purchase_limits (event_id, sheet_rank, max_per_user) VALUES (?, '', ?)", eventID, params.MaxPerUser); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, rank := range ranks {
+		max := params.MaxPerRank[rank]
+		if max == 0 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO event_purchase_limits (event_id, sheet_rank, max_per_user) VALUES (?, ?, ?)", eventID, rank, max); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if limits.MaxPerRank == nil {
+			limits.MaxPerRank = map[string]int{}
+		}
+		limits.MaxPerRank[rank] = max
+	}
+	if err := writeAuditLog(tx, c, "event.edit_limits", "event", eventID, before, limits); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, limits)
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// A minimal QR code encoder (ISO/IEC 18004): byte mode, error correction
+// level M, versions 1 to 10 (up to 213 bytes). That is plenty for ticket
+// tokens and keeps the tables short.
+
+var errQRTooLong = errors.New("qrcode: data too long")
+
+// qrVersionM describes the blocks of one version at level M: ECC codewords per
+// block and the number of data codewords of each block.
+type qrVersionM struct {
+	eccPerBlock int
+	blocks      []int
+	alignment   []int
+}
+
+var qrVersionsM = []qrVersionM{
+	1:  {10, []int{16}, nil},
+	2:  {16, []int{28}, []int{6, 18}},
+	3:  {26, []int{44}, []int{6, 22}},
+	4:  {18, []int{32, 32}, []int{6, 26}},
+	5:  {24, []int{43, 43}, []int{6, 30}},
+	6:  {16, []int{27, 27, 27, 27}, []int{6, 34}},
+	7:  {18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	8:  {22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	9:  {22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	10: {26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// QRCode is the module matrix; true is dark.
+type QRCode struct {
+	Size    int
+	modules [][]bool
+}
+
+func (q *QRCode) Dark(x, y int) bool {
+	return q.modules[y][x]
+}
+
+type qrBuilder struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+func (b *qrBuilder) setFunction(x, y int, dark bool) {
+	b.modules[y][x] = dark
+	b.isFunction[y][x] = true
+}
+
+// encodeQR encodes data in the smallest version that fits.
+func encodeQR(data []byte) (*QRCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersionsM); v++ {
+		capacity := 0
+		for _, n := range qrVersionsM[v].blocks {
+			capacity += n
+		}
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= capacity*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+	spec := qrVersionsM[version]
+
+	codewords := qrCodewords(data, version, spec)
+
+	size := version*4 + 17
+	b := &qrBuilder{size: size, modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for i := range b.modules {
+		b.modules[i] = make([]bool, size)
+		b.isFunction[i] = make([]bool, size)
+	}
+	b.drawFunctionPatterns(version, spec)
+	b.drawCodewords(codewords)
+
+	// 全マスクを試してペナルティが最小のものを使う
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		b.applyMask(mask)
+		b.drawFormatBits(mask)
+		if p := b.penalty(); bestPenalty < 0 || p < bestPenalty {
+			bestMask, bestPenalty = mask, p
+		}
+		b.applyMask(mask)
+	}
+	b.applyMask(bestMask)
+	b.drawFormatBits(bestMask)
+
+	return &QRCode{Size: size, modules: b.modules}, nil
+}
+
+// qrCodewords builds the data codewords, appends Reed-Solomon ECC per block
+// and interleaves the blocks.
+func qrCodewords(data []byte, version int, spec qrVersionM) []byte {
+	capacity := 0
+	for _, n := range spec.blocks {
+		capacity += n
+	}
+
+	var bits []bool
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>uint(i))&1 != 0)
+		}
+	}
+	appendBits(0x4, 4) // byte mode
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, c := range data {
+		appendBits(int(c), 8)
+	}
+	if t := capacity*8 - len(bits); t > 4 {
+		appendBits(0, 4)
+	} else {
+		appendBits(0, t)
+	}
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity*8; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+
+	all := make([]byte, capacity)
+	for i := range all {
+		for j := 0; j < 8; j++ {
+			if bits[i*8+j] {
+				all[i] |= 0x80 >> uint(j)
+			}
+		}
+	}
+
+	divisor := rsDivisor(spec.eccPerBlock)
+	var dataBlocks, eccBlocks [][]byte
+	offset := 0
+	for _, n := range spec.blocks {
+		block := all[offset : offset+n]
+		offset += n
+		dataBlocks = append(dataBlocks, block)
+		eccBlocks = append(eccBlocks, rsRemainder(block, divisor))
+	}
+
+	var result []byte
+	maxLen := spec.blocks[len(spec.blocks)-1]
+	for i := 0; i < maxLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < spec.eccPerBlock; i++ {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+func (b *qrBuilder) drawFunctionPatterns(version int, spec qrVersionM) {
+	for i := 0; i < b.size; i++ {
+		b.setFunction(6, i, i%2 == 0)
+		b.setFunction(i, 6, i%2 == 0)
+	}
+	b.drawFinder(3, 3)
+	b.drawFinder(b.size-4, 3)
+	b.drawFinder(3, b.size-4)
+
+	last := len(spec.alignment) - 1
+	for i, x := range spec.alignment {
+		for j, y := range spec.alignment {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					b.setFunction(x+dx, y+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// フォーマット情報の領域を確保しておく (値はマスク決定後に書く)
+	b.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, c := b.size-11+i%3, i/3
+			b.setFunction(a, c, dark)
+			b.setFunction(c, a, dark)
+		}
+	}
+}
+
+func (b *qrBuilder) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= b.size || yy < 0 || yy >= b.size {
+				continue
+			}
+			dist := qrMax(qrAbs(dx), qrAbs(dy))
+			b.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawFormatBits writes level M and mask with its BCH code in both copies.
+func (b *qrBuilder) drawFormatBits(mask int) {
+	const levelM = 0
+	data := levelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		b.setFunction(8, i, bit(i))
+	}
+	b.setFunction(8, 7, bit(6))
+	b.setFunction(8, 8, bit(7))
+	b.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		b.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		b.setFunction(b.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		b.setFunction(8, b.size-15+i, bit(i))
+	}
+	b.setFunction(8, b.size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag order, two columns at a
+// time from the bottom right, skipping the vertical timing pattern.
+func (b *qrBuilder) drawCodewords(data []byte) {
+	i := 0
+	for right := b.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < b.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = b.size - 1 - vert
+				}
+				if !b.isFunction[y][x] && i < len(data)*8 {
+					b.modules[y][x] = (data[i>>3]>>uint(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (b *qrBuilder) applyMask(mask int) {
+	for y := 0; y < b.size; y++ {
+		for x := 0; x < b.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !b.isFunction[y][x] {
+				b.modules[y][x] = !b.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the matrix with the four rules of the standard; lower is
+// easier to scan. Finder-like patterns are found on run lengths, so they match
+// at any module width, and the border counts as light.
+func (b *qrBuilder) penalty() int {
+	n := b.size
+	score := 0
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			dark, run := false, 0
+			var history [7]int
+			for x := 0; x < n; x++ {
+				var c bool
+				if vertical {
+					c = b.modules[x][y]
+				} else {
+					c = b.modules[y][x]
+				}
+				if c == dark {
+					run++
+					if run == 5 {
+						score += 3
+					} else if run > 5 {
+						score++
+					}
+					continue
+				}
+				qrPushRun(&history, run, n)
+				if !dark {
+					score += 40 * qrFinderPatterns(&history)
+				}
+				dark, run = c, 1
+			}
+			// 端は明モジュールが続いているものとして数える
+			if dark {
+				qrPushRun(&history, run, n)
+				run = 0
+			}
+			qrPushRun(&history, run+n, n)
+			score += 40 * qrFinderPatterns(&history)
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if b.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := b.modules[y][x]
+				if c == b.modules[y][x+1] && c == b.modules[y+1][x] && c == b.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	// 暗モジュールの割合が 50% から 5% 離れるごとに 10 点
+	total := n * n
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	score += 10 * k
+	return score
+}
+
+// qrPushRun adds a run length to the history of the last seven runs, newest
+// first. The first run of a line is light and is extended by the border.
+func qrPushRun(history *[7]int, run, n int) {
+	if history[0] == 0 {
+		run += n
+	}
+	copy(history[1:], history[:6])
+	history[0] = run
+}
+
+// qrFinderPatterns counts the dark-light-dark-dark-dark-light-dark (1:1:3:1:1)
+// patterns ending at the newest light run with four light modules on a side.
+func qrFinderPatterns(history *[7]int) int {
+	k := history[1]
+	if k == 0 || history[2] != k || history[3] != k*3 || history[4] != k || history[5] != k {
+		return 0
+	}
+	count := 0
+	if history[0] >= k*4 && history[6] >= k {
+		count++
+	}
+	if history[6] >= k*4 && history[0] >= k {
+		count++
+	}
+	return count
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// qrQuietZone is the light border required around the symbol, in modules.
+const qrQuietZone = 4
+
+// PNG renders the code with scale pixels per module.
+func (q *QRCode) PNG(scale int) ([]byte, error) {
+	width := (q.Size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code as a scalable image, one unit per module.
+func (q *QRCode) SVG() []byte {
+	width := q.Size + 2*qrQuietZone
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, width, width)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, width, width)
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
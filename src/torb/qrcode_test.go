@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Reference symbols at level M, "#" is dark. Version 7 is the first version
+// with version information blocks.
+var qrReferenceTests = []struct {
+	name    string
+	data    string
+	version int
+	matrix  []string
+}{
+	{
+		name:    "version 1",
+		data:    "TORB-TICKET-01",
+		version: 1,
+		matrix: []string{
+			"#######.##.#..#######",
+			"#.....#.#.##..#.....#",
+			"#.###.#....##.#.###.#",
+			"#.###.#.##.##.#.###.#",
+			"#.###.#..###..#.###.#",
+			"#.....#.......#.....#",
+			"#######.#.#.#.#######",
+			"........###..........",
+			"#.##.###..#...#..#.##",
+			"...#.#.###.#...#.#...",
+			"##.####.#.##.#.#..###",
+			"#.#.##..###....###.#.",
+			"##..#.#.#...#..#####.",
+			"........##..#....#.##",
+			"#######.#.#...###.#..",
+			"#.....#.##.###.#.##.#",
+			"#.###.#..#..#.##.#.#.",
+			"#.###.#.###.#..##..#.",
+			"#.###.#.#...##.......",
+			"#.....#...##.###.#..#",
+			"#######.##.#...#..#..",
+		},
+	},
+	{
+		name:    "version 7",
+		data:    "torb:ticket:v1:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcde",
+		version: 7,
+		matrix: []string{
+			"#######..#.###.....#...#......##.#..#.#######",
+			"#.....#...###...#.#.#.#.####.#.....#..#.....#",
+			"#.###.#.#####...###..#..#...###.##.#..#.###.#",
+			"#.###.#.#..###..###.#.#..#.#..##.#.##.#.###.#",
+			"#.###.#.#..#..#....######..#####..###.#.###.#",
+			"#.....#.##.#.##..#..#...##.#..........#.....#",
+			"#######.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#.#######",
+			"........#.##.####..##...##..#.#.#####........",
+			"#.#####...###...##.######..#.#.#..##..#####..",
+			"..###..#..#...##..#....##...###.#...##.##.#.#",
+			"###...#...#....#####.##.####.....##..####.##.",
+			"...##...#.####.#..#..#.##..#..#.######..#.#..",
+			".#..###...##.....###..#.###.#..#.#.#...#.#.#.",
+			"##..##....#.#.........##...#######..#....##.#",
+			"##..#.#...........#.###.###.#.....##.###...#.",
+			"#.##...#..#..#####.#..###...#..##..##...#.#..",
+			".###.##...#.####.###.#.##.##......#..###.#.#.",
+			"#.###..##..#.#......####...#..#.##.##..####.#",
+			"#####.###.##....#.#.#...####.#.#..##.###.###.",
+			".#......###.##..#..#.....##.###.#...#...####.",
+			"...######.##.##..########.##.###.########..#.",
+			"..###...#..###......#...###..###.#.##...##.##",
+			"#.###.#.#.#.#.#...#.#.#.#..#....#.#.#.#.##...",
+			"..#.#...###....####.#...##..###.#...#...###.#",
+			"...#######.#.##.#.#.######.#..##....######.#.",
+			"#.####.#..##.###.########..#####......##..###",
+			".###..###..##.#.##...###.###......#.....####.",
+			"###......###..##...#.#..##.#..#.########..#.#",
+			".#..#.##...######.#..#.#...#.#.#.....#..##.##",
+			"######..####..###.#.#.###....##.#......#..#.#",
+			".#.#.##.##.....#####....###......##..#.##.##.",
+			"##.##..........##.###.##....#.#######.##..###",
+			"...#.###.#....##..####...###..##.#..##..##...",
+			"..#.#..##...#.###.##..##...##.#.##.#.#.#.##.#",
+			"....#.#.#...#.#.##...#.#.##..#..#.#.#..#...#.",
+			".####..##..##...##......#...#####..#.###..#..",
+			"#..##.#..###....##.#######.#......#.######.#.",
+			"........###....#.##.#...#..#..#..#.##...#.#.#",
+			"#######..#.####.#.###.#.##.#.#..#.#.#.#.#..#.",
+			"#.....#.#..##.####.##...##..###.#...#...####.",
+			"#.###.#.####..#.#.#.#####.##.###.#.######..#.",
+			"#.###.#.#.###...##.#.#..#....###.#.#.#..#.#.#",
+			"#.###.#.###..#.##...#..#####....#.#.#..#...#.",
+			"#.....#..#.#.##.#...##.#.#.####.##.#......#..",
+			"#######.#...#.###.##....##....##....####.#.#.",
+		},
+	},
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, tt := range qrReferenceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr, err := encodeQR([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.version*4 + 17; qr.Size != want || len(tt.matrix) != want {
+				t.Fatalf("size = %d, want %d", qr.Size, want)
+			}
+			for y, row := range tt.matrix {
+				var got bytes.Buffer
+				for x := 0; x < qr.Size; x++ {
+					if qr.Dark(x, y) {
+						got.WriteByte('#')
+					} else {
+						got.WriteByte('.')
+					}
+				}
+				if got.String() != row {
+					t.Errorf("row %d\n got %s\nwant %s", y, got.String(), row)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeQRTooLong(t *testing.T) {
+	if _, err := encodeQR(make([]byte, 214)); err != errQRTooLong {
+		t.Errorf("err = %v, want errQRTooLong", err)
+	}
+	if _, err := encodeQR(make([]byte, 213)); err != nil {
+		t.Errorf("err = %v for 213 bytes", err)
+	}
+}
+
+// The ECC codewords of the "HELLO WORLD" 1-M example of the standard.
+func TestRSRemainder(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = %v, want %v", got, want)
+	}
+}
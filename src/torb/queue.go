@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+const (
+	queueTicketPurpose = "queue"
+	queueTicketHeader  = "X-Queue-Ticket"
+	queuePollInterval  = 5 * time.Second
+	// キューの行ロックを取り合わないよう、入場処理はこの間隔より頻繁には行わない
+	queueAdvanceInterval = time.Second
+
+	queueMinAdmitRate    = 1
+	queueMinAdmissionTTL = 60
+)
+
+// EventQueue is the waiting room of an event. While it is enabled only users
+// holding an admitted, unexpired ticket may reserve. AdmitRate tickets are
+// admitted per minute, each admission is valid for AdmissionTTL seconds.
+type EventQueue struct {
+	EventID      int64 `json:"event_id"`
+	Enabled      bool  `json:"enabled"`
+	Paused       bool  `json:"paused"`
+	AdmitRate    int   `json:"admit_rate"`
+	AdmissionTTL int   `json:"admission_ttl"`
+
+	Waiting  int `json:"waiting"`
+	Admitted int `json:"admitted"`
+}
+
+type QueueTicket struct {
+	ID         int64      `json:"-"`
+	EventID    int64      `json:"event_id"`
+	UserID     int64      `json:"-"`
+	AdmittedAt *time.Time `json:"-"`
+	ExpiresAt  *time.Time `json:"-"`
+
+	Token         string `json:"ticket"`
+	Position      int    `json:"position"`
+	Admitted      bool   `json:"admitted"`
+	ExpiresAtUnix int64  `json:"expires_at,omitempty"`
+	EstimatedWait int    `json:"estimated_wait,omitempty"`
+	PollAfter     int    `json:"poll_after,omitempty"`
+}
+
+func queueTicketToken(ticket *QueueTicket) string {
+	return signToken(queueTicketPurpose, fmt.Sprintf("%d:%d:%d", ticket.ID, ticket.EventID, ticket.UserID))
+}
+
+func queueSessionKey(eventID int64) string {
+	return "queue_ticket_" + strconv.FormatInt(eventID, 10)
+}
+
+// queueTicketFromRequest returns the id of the ticket presented in the
+// X-Queue-Ticket header, or stored in the session when the header is absent.
+// Tickets of other events or users are ignored.
+func queueTicketFromRequest(c echo.Context, eventID, userID int64) (int64, bool) {
+	token := c.Request().Header.Get(queueTicketHeader)
+	if token == "" {
+		sess, _ := session.Get("session", c)
+		token, _ = sess.Values[queueSessionKey(eventID)].(string)
+	}
+	payload, ok := verifyToken(queueTicketPurpose, token)
+	if !ok {
+		return 0, false
+	}
+	var ticketID, ticketEventID, ticketUserID int64
+	if _, err := fmt.Sscanf(payload, "%d:%d:%d", &ticketID, &ticketEventID, &ticketUserID); err != nil {
+		return 0, false
+	}
+	if ticketEventID != eventID || ticketUserID != userID {
+		return 0, false
+	}
+	return ticketID, true
+}
+
+func getEventQueue(eventID int64) (*EventQueue, error) {
+	queue := EventQueue{EventID: eventID}
+	err := db.QueryRow("SELECT enabled_fg, paused_fg, admit_rate, admission_ttl FROM event_queues WHERE event_id = ?", eventID).Scan(&queue.Enabled, &queue.Paused, &queue.AdmitRate, &queue.AdmissionTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &queue, nil
+}
+
+func queueEnabled(eventID int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT enabled_fg FROM event_queues WHERE event_id = ?", eventID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// advanceQueue admits waiting tickets at the configured rate. Admissions are
+// earned continuously while the queue runs; at most one minute worth can pile
+// up, so a queue that was empty for a while does not admit a burst.
+func advanceQueue(eventID int64) error {
+	now := time.Now().UTC()
+
+	var updatedAt time.Time
+	if err := db.QueryRow("SELECT budget_updated_at FROM event_queues WHERE event_id = ?", eventID).Scan(&updatedAt); err != nil {
+		return err
+	}
+	if now.Sub(updatedAt) < queueAdvanceInterval {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var queue EventQueue
+	var budget float64
+	if err := tx.QueryRow("SELECT enabled_fg, paused_fg, admit_rate, admission_ttl, admit_budget, budget_updated_at FROM event_queues WHERE event_id = ? FOR UPDATE", eventID).Scan(&queue.Enabled, &queue.Paused, &queue.AdmitRate, &queue.AdmissionTTL, &budget, &updatedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !queue.Enabled || now.Sub(updatedAt) < queueAdvanceInterval {
+		tx.Rollback()
+		return nil
+	}
+
+	if !queue.Paused {
+		budget = math.Min(budget+now.Sub(updatedAt).Minutes()*float64(queue.AdmitRate), float64(queue.AdmitRate))
+		if n := int(budget); n > 0 {
+			res, err := tx.Exec("UPDATE queue_tickets SET admitted_at = ?, expires_at = ? WHERE event_id = ? AND admitted_at IS NULL ORDER BY id LIMIT ?",
+				now, now.Add(time.Duration(queue.AdmissionTTL)*time.Second), eventID, n)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			admitted, err := res.RowsAffected()
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			budget -= float64(admitted)
+		}
+	}
+	if _, err := tx.Exec("UPDATE event_queues SET admit_budget = ?, budget_updated_at = ? WHERE event_id = ?", budget, now, eventID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// getQueueTicketStatus fills the position, admission and wait estimate of the ticket.
+func getQueueTicketStatus(ticketID int64, queue *EventQueue) (*QueueTicket, error) {
+	var ticket QueueTicket
+	if err := db.QueryRow("SELECT id, event_id, user_id, admitted_at, expires_at FROM queue_tickets WHERE id = ?", ticketID).Scan(&ticket.ID, &ticket.EventID, &ticket.UserID, &ticket.AdmittedAt, &ticket.ExpiresAt); err != nil {
+		return nil, err
+	}
+	ticket.Token = queueTicketToken(&ticket)
+
+	if ticket.AdmittedAt != nil {
+		ticket.Admitted = true
+		ticket.ExpiresAtUnix = ticket.ExpiresAt.Unix()
+		return &ticket, nil
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM queue_tickets WHERE event_id = ? AND admitted_at IS NULL AND id <= ?", ticket.EventID, ticket.ID).Scan(&ticket.Position); err != nil {
+		return nil, err
+	}
+	if queue.AdmitRate > 0 && !queue.Paused {
+		ticket.EstimatedWait = int(math.Ceil(float64(ticket.Position) * 60 / float64(queue.AdmitRate)))
+	}
+	ticket.PollAfter = int(queuePollInterval / time.Second)
+	return &ticket, nil
+}
+
+// requireQueueAdmission lets the reservation through when the event has no
+// active queue or the request carries an admitted, unexpired ticket of the user.
+// It returns the ticket to pass to useQueueAdmission, or 0 without a queue.
+func requireQueueAdmission(c echo.Context, eventID, userID int64) (int64, error) {
+	enabled, err := queueEnabled(eventID)
+	if err != nil {
+		return 0, err
+	}
+	if !enabled {
+		return 0, nil
+	}
+	ticketID, ok := queueTicketFromRequest(c, eventID, userID)
+	if !ok {
+		return 0, forbiddenError("queue_ticket_required")
+	}
+	var expiresAt *time.Time
+	if err := db.QueryRow("SELECT expires_at FROM queue_tickets WHERE id = ?", ticketID).Scan(&expiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, forbiddenError("queue_ticket_required")
+		}
+		return 0, err
+	}
+	if expiresAt == nil {
+		return 0, forbiddenError("queue_not_admitted")
+	}
+	if !expiresAt.After(time.Now()) {
+		return 0, forbiddenError("queue_admission_expired")
+	}
+	return ticketID, nil
+}
+
+// useQueueAdmission ends the admission of the ticket in the transaction making
+// the reservation, so that one admission makes a single reservation. A used
+// ticket is replaced by a new one when the user joins the queue again.
+func useQueueAdmission(tx *sql.Tx, ticketID int64) error {
+	if ticketID == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	res, err := tx.Exec("UPDATE queue_tickets SET expires_at = ? WHERE id = ? AND expires_at > ?", now, ticketID, now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return forbiddenError("queue_admission_expired")
+	}
+	return nil
+}
+
+func openQueue(c echo.Context) (*User, *EventQueue, error) {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, nil, notFoundError("not_found")
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	queue, err := getEventQueue(eventID)
+	if err == sql.ErrNoRows || (err == nil && !queue.Enabled) {
+		return nil, nil, notFoundError("queue_not_found")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, queue, nil
+}
+
+// joinQueueHandler issues a ticket for the event, or returns the current one.
+// A ticket whose admission expired is replaced by a new one at the end of the
+// queue. The ticket is also kept in the session for browser clients.
+func joinQueueHandler(c echo.Context) error {
+	user, queue, err := openQueue(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM queue_tickets WHERE event_id = ? AND user_id = ? AND expires_at <= ?", queue.EventID, user.ID, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT IGNORE INTO queue_tickets (event_id, user_id, created_at) VALUES (?, ?, ?)", queue.EventID, user.ID, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var ticketID int64
+	if err := tx.QueryRow("SELECT id FROM queue_tickets WHERE event_id = ? AND user_id = ?", queue.EventID, user.ID).Scan(&ticketID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := advanceQueue(queue.EventID); err != nil {
+		return err
+	}
+	ticket, err := getQueueTicketStatus(ticketID, queue)
+	if err != nil {
+		return err
+	}
+
+	sess, _ := session.Get("session", c)
+	sess.Values[queueSessionKey(queue.EventID)] = ticket.Token
+	sess.Save(c.Request(), c.Response())
+	return c.JSON(200, ticket)
+}
+
+// getQueueStatusHandler is polled by waiting clients. Every poll also admits
+// the tickets whose turn has come.
+func getQueueStatusHandler(c echo.Context) error {
+	user, queue, err := openQueue(c)
+	if err != nil {
+		return err
+	}
+	ticketID, ok := queueTicketFromRequest(c, queue.EventID, user.ID)
+	if !ok {
+		return notFoundError("queue_ticket_not_found")
+	}
+	if err := advanceQueue(queue.EventID); err != nil {
+		return err
+	}
+	ticket, err := getQueueTicketStatus(ticketID, queue)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundError("queue_ticket_not_found")
+		}
+		return err
+	}
+	if !ticket.Admitted {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(ticket.PollAfter))
+	}
+	return c.JSON(200, ticket)
+}
+
+func getAdminEventQueue(eventID int64) (*EventQueue, error) {
+	queue, err := getEventQueue(eventID)
+	if err == sql.ErrNoRows {
+		return &EventQueue{EventID: eventID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow("SELECT COALESCE(SUM(admitted_at IS NULL), 0), COALESCE(SUM(expires_at > ?), 0) FROM queue_tickets WHERE event_id = ?", time.Now().UTC(), eventID).Scan(&queue.Waiting, &queue.Admitted)
+	return queue, err
+}
+
+func getEventQueueHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	if _, err := getEvent(eventID, -1); err != nil {
+		return err
+	}
+	queue, err := getAdminEventQueue(eventID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, queue)
+}
+
+// editEventQueueHandler enables, disables or reconfigures the queue. Disabling
+// drops every ticket so that a later queue starts empty. admit_rate and
+// admission_ttl are required only when the queue is enabled.
+func editEventQueueHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params struct {
+		Enabled      bool `json:"enabled"`
+		AdmitRate    int  `json:"admit_rate" validate:"max=100000"`
+		AdmissionTTL int  `json:"admission_ttl" validate:"max=3600"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	if _, err := getEvent(eventID, -1); err != nil {
+		return err
+	}
+	before, err := getAdminEventQueue(eventID)
+	if err != nil {
+		return err
+	}
+	// 無効にするだけなら設定は省略でき、省略した値はそのまま残す
+	if !params.Enabled {
+		if params.AdmitRate == 0 {
+			params.AdmitRate = before.AdmitRate
+		}
+		if params.AdmissionTTL == 0 {
+			params.AdmissionTTL = before.AdmissionTTL
+		}
+	}
+	var fields []FieldError
+	if (params.Enabled || params.AdmitRate != 0) && params.AdmitRate < queueMinAdmitRate {
+		fields = append(fields, FieldError{Field: "admit_rate", Code: "too_small", Message: fmt.Sprintf("must be at least %d", queueMinAdmitRate)})
+	}
+	if (params.Enabled || params.AdmissionTTL != 0) && params.AdmissionTTL < queueMinAdmissionTTL {
+		fields = append(fields, FieldError{Field: "admission_ttl", Code: "too_small", Message: fmt.Sprintf("must be at least %d", queueMinAdmissionTTL)})
+	}
+	if fields != nil {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// 無効から有効に切り替えたときは入場枠を貯め直す（代入は左から順に評価される）
+	if _, err := tx.Exec("INSERT INTO event_queues (event_id, enabled_fg, paused_fg, admit_rate, admission_ttl, admit_budget, budget_updated_at) VALUES (?, ?, 0, ?, ?, 0, ?)"+
+		" ON DUPLICATE KEY UPDATE admit_budget = IF(enabled_fg, admit_budget, 0), budget_updated_at = IF(enabled_fg, budget_updated_at, VALUES(budget_updated_at)),"+
+		" enabled_fg = VALUES(enabled_fg), admit_rate = VALUES(admit_rate), admission_ttl = VALUES(admission_ttl)",
+		eventID, params.Enabled, params.AdmitRate, params.AdmissionTTL, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !params.Enabled {
+		if _, err := tx.Exec("DELETE FROM queue_tickets WHERE event_id = ?", eventID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	after := &EventQueue{EventID: eventID, Enabled: params.Enabled, Paused: before.Paused, AdmitRate: params.AdmitRate, AdmissionTTL: params.AdmissionTTL}
+	if err := writeAuditLog(tx, c, "event.edit_queue", "event", eventID, before, after); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	queue, err := getAdminEventQueue(eventID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, queue)
+}
+
+// pauseEventQueueHandler stops (paused true) or restarts admissions. Tickets
+// keep their place; time spent paused does not earn admissions.
+func pauseEventQueueHandler(paused bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return notFoundError("not_found")
+		}
+		if err := advanceQueue(eventID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		var wasPaused bool
+		if err := tx.QueryRow("SELECT paused_fg FROM event_queues WHERE event_id = ? FOR UPDATE", eventID).Scan(&wasPaused); err != nil {
+			tx.Rollback()
+			if err == sql.ErrNoRows {
+				return notFoundError("queue_not_found")
+			}
+			return err
+		}
+		if _, err := tx.Exec("UPDATE event_queues SET paused_fg = ?, budget_updated_at = ? WHERE event_id = ?", paused, time.Now().UTC(), eventID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		action := "event.resume_queue"
+		if paused {
+			action = "event.pause_queue"
+		}
+		if err := writeAuditLog(tx, c, action, "event", eventID, echo.Map{"paused": wasPaused}, echo.Map{"paused": paused}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		queue, err := getAdminEventQueue(eventID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, queue)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// rateLimitRule is a token bucket: Burst tokens at most, refilled at Rate tokens
+// per second. Every request takes one token.
+type rateLimitRule struct {
+	Rate  float64
+	Burst int
+}
+
+// parseRateLimitRule parses "rate,burst" (e.g. "2,5"). "off" disables the rule.
+func parseRateLimitRule(s string) (*rateLimitRule, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("rate limit %q: want rate,burst", s)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("rate limit %q: bad rate", s)
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("rate limit %q: bad burst", s)
+	}
+	return &rateLimitRule{Rate: rate, Burst: burst}, nil
+}
+
+// rateLimitConfig holds the rules applied by rateLimitMiddleware. PerRoute is
+// keyed by "METHOD path" with the path as registered, e.g.
+// "POST /api/events/:id/actions/reserve", and counted per user (or per IP when
+// nobody is logged in).
+type rateLimitConfig struct {
+	PerIP    *rateLimitRule
+	PerUser  *rateLimitRule
+	PerRoute map[string]*rateLimitRule
+}
+
+// loadRateLimitConfig reads the rules from the environment. Every limit is
+// opt-in; with nothing set no request is limited.
+//
+//	RATE_LIMIT_IP      rate,burst or off
+//	RATE_LIMIT_USER    rate,burst or off
+//	RATE_LIMIT_ROUTES  "METHOD path=rate,burst;..."
+//
+// For example RATE_LIMIT_ROUTES="POST /api/events/:id/actions/reserve=2,5;POST /api/actions/login=1,10".
+func loadRateLimitConfig(getenv func(string) string) (rateLimitConfig, error) {
+	config := rateLimitConfig{PerRoute: map[string]*rateLimitRule{}}
+
+	var err error
+	if v := getenv("RATE_LIMIT_IP"); v != "" {
+		if config.PerIP, err = parseRateLimitRule(v); err != nil {
+			return config, err
+		}
+	}
+	if v := getenv("RATE_LIMIT_USER"); v != "" {
+		if config.PerUser, err = parseRateLimitRule(v); err != nil {
+			return config, err
+		}
+	}
+	for _, entry := range strings.Split(getenv("RATE_LIMIT_ROUTES"), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return config, fmt.Errorf("rate limit route %q: want METHOD path=rate,burst", entry)
+		}
+		rule, err := parseRateLimitRule(entry[i+1:])
+		if err != nil {
+			return config, err
+		}
+		route := strings.TrimSpace(entry[:i])
+		if rule == nil {
+			delete(config.PerRoute, route)
+			continue
+		}
+		config.PerRoute[route] = rule
+	}
+	return config, nil
+}
+
+func (c rateLimitConfig) empty() bool {
+	return c.PerIP == nil && c.PerUser == nil && len(c.PerRoute) == 0
+}
+
+type rateLimitBucket struct {
+	key  string
+	rule *rateLimitRule
+}
+
+// rateLimitStore keeps the buckets. take removes one token from every bucket
+// when all of them have one; otherwise it takes none and returns how long to
+// wait until they all do.
+type rateLimitStore interface {
+	take(buckets []rateLimitBucket, now time.Time) (bool, time.Duration, error)
+}
+
+// refillBucket returns the tokens after refilling from updatedAt to now.
+func refillBucket(tokens float64, updatedAt, now time.Time, rule *rateLimitRule) float64 {
+	if elapsed := now.Sub(updatedAt).Seconds(); elapsed > 0 {
+		tokens += elapsed * rule.Rate
+	}
+	return math.Min(tokens, float64(rule.Burst))
+}
+
+func waitForToken(tokens float64, rule *rateLimitRule) time.Duration {
+	return time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// memoryRateLimitStore keeps buckets in process memory. Each instance counts on
+// its own, so limits multiply by the number of instances.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+}
+
+func (s *memoryRateLimitStore) take(buckets []rateLimitBucket, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 満タンに戻ったバケツは消しても結果が変わらないので定期的に捨てる
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.Sub(b.updatedAt) > 10*time.Minute {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	var wait time.Duration
+	for _, bucket := range buckets {
+		b, ok := s.buckets[bucket.key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(bucket.rule.Burst), updatedAt: now}
+			s.buckets[bucket.key] = b
+		}
+		b.tokens = refillBucket(b.tokens, b.updatedAt, now, bucket.rule)
+		b.updatedAt = now
+		if b.tokens < 1 {
+			if w := waitForToken(b.tokens, bucket.rule); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait, nil
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket.key].tokens--
+	}
+	return true, 0, nil
+}
+
+// mysqlRateLimitStore shares the buckets between instances through the
+// rate_limit_buckets table. It costs a transaction per rule and request, so
+// prefer the memory store unless several instances serve the same users.
+type mysqlRateLimitStore struct{}
+
+func (mysqlRateLimitStore) take(buckets []rateLimitBucket, now time.Time) (bool, time.Duration, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	// buckets はキー順に並んでいるので、ロックの取り合いでデッドロックしない。
+	// 無い行を FOR UPDATE で読むとギャップロック同士で詰まるので、先に行を作ってからロックする
+	tokens := make([]float64, len(buckets))
+	var wait time.Duration
+	for i, bucket := range buckets {
+		if _, err := tx.Exec("INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE bucket_key = bucket_key", bucket.key, float64(bucket.rule.Burst), now); err != nil {
+			tx.Rollback()
+			return false, 0, err
+		}
+		var updatedAt time.Time
+		if err := tx.QueryRow("SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket_key = ? FOR UPDATE", bucket.key).Scan(&tokens[i], &updatedAt); err != nil {
+			tx.Rollback()
+			return false, 0, err
+		}
+		tokens[i] = refillBucket(tokens[i], updatedAt, now, bucket.rule)
+		if tokens[i] < 1 {
+			if w := waitForToken(tokens[i], bucket.rule); w > wait {
+				wait = w
+			}
+		}
+	}
+
+	allowed := wait == 0
+	for i, bucket := range buckets {
+		if allowed {
+			tokens[i]--
+		}
+		if _, err := tx.Exec("UPDATE rate_limit_buckets SET tokens = ?, updated_at = ? WHERE bucket_key = ?", tokens[i], now, bucket.key); err != nil {
+			tx.Rollback()
+			return false, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, nil
+}
+
+// newRateLimitStore builds a store from a spec: "memory" (default) or "mysql".
+func newRateLimitStore(spec string) rateLimitStore {
+	switch spec {
+	case "mysql":
+		return mysqlRateLimitStore{}
+	}
+	return newMemoryRateLimitStore()
+}
+
+// rateLimitMiddleware applies the per-IP, per-user and per-route buckets. A
+// request over any limit is answered with 429 and Retry-After and takes no
+// token from the other buckets. Store failures are logged and let the request
+// through.
+func rateLimitMiddleware(config rateLimitConfig, store rateLimitStore) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if config.empty() {
+			return next
+		}
+		return func(c echo.Context) error {
+			ip := clientIP(c)
+			userID := sessUserID(c)
+			client := "ip:" + ip
+			if userID != 0 {
+				client = "user:" + strconv.FormatInt(userID, 10)
+			}
+			route := c.Request().Method + " " + c.Path()
+
+			var buckets []rateLimitBucket
+			if config.PerIP != nil {
+				buckets = append(buckets, rateLimitBucket{"ip:" + ip, config.PerIP})
+			}
+			if rule := config.PerRoute[route]; rule != nil {
+				buckets = append(buckets, rateLimitBucket{"route:" + route + ":" + client, rule})
+			}
+			if userID != 0 && config.PerUser != nil {
+				buckets = append(buckets, rateLimitBucket{client, config.PerUser})
+			}
+			if len(buckets) == 0 {
+				return next(c)
+			}
+			sort.Slice(buckets, func(i, j int) bool { return buckets[i].key < buckets[j].key })
+
+			ok, wait, err := store.take(buckets, time.Now())
+			if err != nil {
+				log.Printf("rate limit store error route=%s client=%s: %v", route, client, err)
+				return next(c)
+			}
+			if !ok {
+				c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				return tooManyRequestsError("rate_limited")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	resaleStatusActive    = "active"
+	resaleStatusSold      = "sold"
+	resaleStatusWithdrawn = "withdrawn"
+
+	// 管理者が設定していないイベントは額面までの価格で出品でき、手数料は 10%
+	resaleDefaultMaxPricePercent = 100
+	resaleDefaultFeePercent      = 10
+
+	saleTypePrimary = "primary"
+	saleTypeResold  = "resold"
+	saleTypeResale  = "resale"
+)
+
+// ResalePolicy is set per event by administrators. Listings are capped at
+// MaxPricePercent of the face value and FeePercent of the sale price is kept
+// as a fee; the seller receives the rest.
+type ResalePolicy struct {
+	Enabled         bool `json:"enabled"`
+	MaxPricePercent int  `json:"max_price_percent"`
+	FeePercent      int  `json:"fee_percent"`
+}
+
+func (p *ResalePolicy) maxPrice(facePrice int64) int64 {
+	return facePrice * int64(p.MaxPricePercent) / 100
+}
+
+func (p *ResalePolicy) fee(price int64) int64 {
+	return price * int64(p.FeePercent) / 100
+}
+
+func getResalePolicy(q queryRower, eventID int64) (*ResalePolicy, error) {
+	policy := &ResalePolicy{Enabled: true, MaxPricePercent: resaleDefaultMaxPricePercent, FeePercent: resaleDefaultFeePercent}
+	err := q.QueryRow("SELECT enabled, max_price_percent, fee_percent FROM event_resale_policies WHERE event_id = ?", eventID).Scan(&policy.Enabled, &policy.MaxPricePercent, &policy.FeePercent)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// ResaleListing offers a reserved seat to other users. When it is bought the
+// seller's reservation is ended and a new reservation is made for the buyer,
+// so the original stays in the history and the sales reports.
+type ResaleListing struct {
+	ID             int64      `json:"id"`
+	ReservationID  int64      `json:"reservation_id,omitempty"`
+	EventID        int64      `json:"event_id"`
+	Title          string     `json:"title"`
+	SheetRank      string     `json:"sheet_rank"`
+	SheetNum       int64      `json:"sheet_num"`
+	Price          int64      `json:"price"`
+	FacePrice      int64      `json:"face_price"`
+	SellerUserID   int64      `json:"-"`
+	Status         string     `json:"status"`
+	Fee            int64      `json:"fee,omitempty"`
+	SellerProceeds int64      `json:"seller_proceeds,omitempty"`
+	CreatedAt      time.Time  `json:"-"`
+	ClosedAt       *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+	ClosedAtUnix  int64 `json:"closed_at,omitempty"`
+}
+
+const resaleListingQuery = "SELECT l.id, l.reservation_id, l.event_id, e.title, s.`rank`, s.num, l.price, l.face_price, l.seller_user_id, l.status, COALESCE(rs.fee, 0), COALESCE(rs.seller_proceeds, 0), l.created_at, l.closed_at" +
+	" FROM resale_listings l INNER JOIN events e ON e.id = l.event_id INNER JOIN sheets s ON s.id = l.sheet_id LEFT JOIN resale_sales rs ON rs.listing_id = l.id"
+
+func scanResaleListing(row rowScanner) (*ResaleListing, error) {
+	var l ResaleListing
+	if err := row.Scan(&l.ID, &l.ReservationID, &l.EventID, &l.Title, &l.SheetRank, &l.SheetNum, &l.Price, &l.FacePrice, &l.SellerUserID, &l.Status, &l.Fee, &l.SellerProceeds, &l.CreatedAt, &l.ClosedAt); err != nil {
+		return nil, err
+	}
+	l.CreatedAtUnix = l.CreatedAt.Unix()
+	if l.ClosedAt != nil {
+		l.ClosedAtUnix = l.ClosedAt.Unix()
+	}
+	return &l, nil
+}
+
+func getResaleListing(q queryRower, id int64) (*ResaleListing, error) {
+	l, err := scanResaleListing(q.QueryRow(resaleListingQuery+" WHERE l.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("listing_not_found")
+	}
+	return l, err
+}
+
+func queryResaleListings(query string, args ...interface{}) ([]*ResaleListing, error) {
+	rows, err := db.Query(resaleListingQuery+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	listings := []*ResaleListing{}
+	for rows.Next() {
+		l, err := scanResaleListing(rows)
+		if err != nil {
+			return nil, err
+		}
+		listings = append(listings, l)
+	}
+	return listings, rows.Err()
+}
+
+// checkResellable rejects listing or buying seats of closed events, of events
+// whose policy disables resale and of tickets that have been used or are
+// being transferred.
+func checkResellable(tx *sql.Tx, eventID, reservationID int64, closed bool) (*ResalePolicy, error) {
+	if closed {
+		return nil, conflictError("event_closed")
+	}
+	policy, err := getResalePolicy(tx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if !policy.Enabled {
+		return nil, forbiddenError("resale_disabled")
+	}
+	var checkedIn, transfers int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM checkins WHERE reservation_id = ?", reservationID).Scan(&checkedIn); err != nil {
+		return nil, err
+	}
+	if checkedIn > 0 {
+		return nil, conflictError("already_checked_in")
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM ticket_transfers WHERE reservation_id = ? AND status = ? AND expires_at > ?", reservationID, transferStatusPending, time.Now().UTC()).Scan(&transfers); err != nil {
+		return nil, err
+	}
+	if transfers > 0 {
+		return nil, conflictError("transfer_pending")
+	}
+	return policy, nil
+}
+
+// withdrawResaleListings closes the active listing of a reservation that is
+// canceled by its holder.
+func withdrawResaleListings(tx *sql.Tx, reservationID int64) error {
+	_, err := tx.Exec("UPDATE resale_listings SET status = ?, closed_at = ? WHERE reservation_id = ? AND status = ?", resaleStatusWithdrawn, time.Now().UTC(), reservationID, resaleStatusActive)
+	return err
+}
+
+// postResaleListingHandler lists an active reservation of the logged in user.
+func postResaleListingHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	reservationID, err := strconv.ParseInt(c.Param("reservation_id"), 10, 64)
+	if err != nil {
+		return notFoundError("reservation_not_found")
+	}
+	var params struct {
+		Price int64 `json:"price" validate:"min=1"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var eventID, sheetID, eventPrice int64
+	var closed bool
+	if err := tx.QueryRow("SELECT r.event_id, r.sheet_id, e.price, e.closed_fg FROM reservations r INNER JOIN events e ON e.id = r.event_id WHERE r.id = ? AND r.user_id = ? AND r.canceled_at IS NULL FOR UPDATE", reservationID, loginUser.ID).Scan(&eventID, &sheetID, &eventPrice, &closed); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("reservation_not_found")
+		}
+		return err
+	}
+	policy, err := checkResellable(tx, eventID, reservationID, closed)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	sheet, _ := getSheetByID(sheetID)
+	if sheet == nil {
+		tx.Rollback()
+		return notFoundError("invalid_sheet")
+	}
+	facePrice := eventPrice + sheet.Price
+	if max := policy.maxPrice(facePrice); params.Price > max {
+		tx.Rollback()
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: []FieldError{{Field: "price", Code: "out_of_range", Message: "must be between 1 and " + strconv.FormatInt(max, 10)}}}
+	}
+	var listed int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM resale_listings WHERE reservation_id = ? AND status = ?", reservationID, resaleStatusActive).Scan(&listed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if listed > 0 {
+		tx.Rollback()
+		return conflictError("already_listed")
+	}
+
+	res, err := tx.Exec("INSERT INTO resale_listings (reservation_id, event_id, sheet_id, seller_user_id, price, face_price, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		reservationID, eventID, sheetID, loginUser.ID, params.Price, facePrice, resaleStatusActive, time.Now().UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	listingID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	listing, err := getResaleListing(tx, listingID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "resale.list", "reservation", reservationID, nil, listing); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(201, listing)
+}
+
+// getResaleListingsHandler lists the seats of an event on sale, cheapest
+// first. Sellers are not disclosed.
+func getResaleListingsHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	event, err := getEvent(eventID, -1)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundError("not_found")
+		}
+		return err
+	}
+	if !event.PublicFg {
+		return notFoundError("not_found")
+	}
+	listings, err := queryResaleListings(" INNER JOIN reservations r ON r.id = l.reservation_id AND r.user_id = l.seller_user_id AND r.canceled_at IS NULL"+
+		" WHERE l.event_id = ? AND l.status = ? ORDER BY l.price, l.id", eventID, resaleStatusActive)
+	if err != nil {
+		return err
+	}
+	for _, l := range listings {
+		l.ReservationID = 0
+	}
+	return c.JSON(200, listings)
+}
+
+// getUserResaleListingsHandler lists the listings of the logged in user with
+// the fee and proceeds of sold ones.
+func getUserResaleListingsHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	listings, err := queryResaleListings(" WHERE l.seller_user_id = ? ORDER BY l.id DESC LIMIT 50", loginUser.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, listings)
+}
+
+// lockResaleListing locks an active listing of :id.
+func lockResaleListing(c echo.Context, tx *sql.Tx) (*ResaleListing, error) {
+	listingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, notFoundError("listing_not_found")
+	}
+	var status string
+	if err := tx.QueryRow("SELECT status FROM resale_listings WHERE id = ? FOR UPDATE", listingID).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFoundError("listing_not_found")
+		}
+		return nil, err
+	}
+	if status != resaleStatusActive {
+		return nil, conflictError("listing_not_active")
+	}
+	return getResaleListing(tx, listingID)
+}
+
+// withdrawResaleListingHandler takes a listing of the logged in user off sale.
+func withdrawResaleListingHandler(c echo.Context) error {
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	listing, err := lockResaleListing(c, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if listing.SellerUserID != user.ID {
+		tx.Rollback()
+		return notFoundError("listing_not_found")
+	}
+	if _, err := tx.Exec("UPDATE resale_listings SET status = ?, closed_at = ? WHERE id = ?", resaleStatusWithdrawn, time.Now().UTC(), listing.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "resale.withdraw", "reservation", listing.ReservationID, echo.Map{"listing_id": listing.ID, "status": resaleStatusActive}, echo.Map{"listing_id": listing.ID, "status": resaleStatusWithdrawn}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	withdrawn, err := getResaleListing(tx, listing.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, withdrawn)
+}
+
+// buyResaleListingHandler buys a listing for the logged in user. In one
+// transaction the seller's reservation is ended, a reservation of the same
+// sheet is made for the buyer and the sale is recorded with its fee split.
+func buyResaleListingHandler(c echo.Context) error {
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	listing, err := lockResaleListing(c, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if listing.SellerUserID == user.ID {
+		tx.Rollback()
+		return conflictError("own_listing")
+	}
+
+	var ownerID, sheetID int64
+	var canceledAt *time.Time
+	var public, closed bool
+	if err := tx.QueryRow("SELECT r.user_id, r.sheet_id, r.canceled_at, e.public_fg, e.closed_fg FROM reservations r INNER JOIN events e ON e.id = r.event_id WHERE r.id = ? FOR UPDATE", listing.ReservationID).Scan(&ownerID, &sheetID, &canceledAt, &public, &closed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if canceledAt != nil || ownerID != listing.SellerUserID || !public {
+		tx.Rollback()
+		return conflictError("listing_not_active")
+	}
+	policy, err := checkResellable(tx, listing.EventID, listing.ReservationID, closed)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := checkPurchaseLimits(tx, user.ID, listing.EventID, listing.SheetRank); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", now, listing.ReservationID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?)", listing.EventID, sheetID, user.ID, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	reservationID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	fee := policy.fee(listing.Price)
+	if _, err := tx.Exec("INSERT INTO resale_sales (listing_id, event_id, original_reservation_id, reservation_id, seller_user_id, buyer_user_id, price, fee, seller_proceeds, sold_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		listing.ID, listing.EventID, listing.ReservationID, reservationID, listing.SellerUserID, user.ID, listing.Price, fee, listing.Price-fee, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE resale_listings SET status = ?, closed_at = ? WHERE id = ?", resaleStatusSold, now, listing.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	sale := echo.Map{"listing_id": listing.ID, "original_reservation_id": listing.ReservationID, "reservation_id": reservationID, "event_id": listing.EventID, "sheet_rank": listing.SheetRank, "sheet_num": listing.SheetNum,
+		"seller_user_id": listing.SellerUserID, "buyer_user_id": user.ID, "price": listing.Price, "fee": fee, "seller_proceeds": listing.Price - fee}
+	if err := writeAuditLog(tx, c, "reservation.resale", "reservation", reservationID, echo.Map{"reservation_id": listing.ReservationID, "user_id": listing.SellerUserID}, sale); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueNotification(tx, user.ID, notificationReservationConfirmed, map[string]interface{}{
+		"Title": listing.Title, "SheetRank": listing.SheetRank, "SheetNum": listing.SheetNum, "ReservationID": reservationID,
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueNotification(tx, listing.SellerUserID, notificationResaleSold, map[string]interface{}{
+		"Title": listing.Title, "SheetRank": listing.SheetRank, "SheetNum": listing.SheetNum, "Price": listing.Price, "Fee": fee, "Proceeds": listing.Price - fee,
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueWebhookEvent(tx, webhookReservationResold, sale); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(202, echo.Map{
+		"id":         reservationID,
+		"sheet_rank": listing.SheetRank,
+		"sheet_num":  listing.SheetNum,
+		"price":      listing.Price,
+	})
+}
+
+// editResalePolicyHandler sets whether and at what price cap and fee seats of
+// an event can be resold. Existing listings above a lowered cap stay listed.
+func editResalePolicyHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params struct {
+		Enabled         bool `json:"enabled"`
+		MaxPricePercent int  `json:"max_price_percent" validate:"min=1,max=1000"`
+		FeePercent      int  `json:"fee_percent" validate:"min=0,max=100"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM events WHERE id = ? FOR UPDATE", eventID).Scan(&id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	before, err := getResalePolicy(tx, eventID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO event_resale_policies (event_id, enabled, max_price_percent, fee_percent) VALUES (?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE enabled = VALUES(enabled), max_price_percent = VALUES(max_price_percent), fee_percent = VALUES(fee_percent)",
+		eventID, params.Enabled, params.MaxPricePercent, params.FeePercent); err != nil {
+		tx.Rollback()
+		return err
+	}
+	after := &ResalePolicy{Enabled: params.Enabled, MaxPricePercent: params.MaxPricePercent, FeePercent: params.FeePercent}
+	if err := writeAuditLog(tx, c, "event.edit_resale_policy", "event", eventID, before, after); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, after)
+}
+
+type resaleSale struct {
+	ResaleOf int64
+	Price    int64
+	Fee      int64
+}
+
+// applyResaleSales marks rows of the sales report by sale type: reservations
+// bought on the resale market are "resale" with the resale price and fee (price
+// stays the face value), other reservations that were sold there are "resold"
+// (their canceled_at is the time of the resale) and all others are "primary".
+// eventID 0 means all events.
+func applyResaleSales(reports []Report, eventID int64) error {
+	query := "SELECT original_reservation_id, reservation_id, price, fee FROM resale_sales"
+	var args []interface{}
+	if eventID != 0 {
+		query += " WHERE event_id = ?"
+		args = append(args, eventID)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	resold := map[int64]bool{}
+	sales := map[int64]*resaleSale{}
+	for rows.Next() {
+		var original, reservationID int64
+		var sale resaleSale
+		if err := rows.Scan(&original, &reservationID, &sale.Price, &sale.Fee); err != nil {
+			return err
+		}
+		sale.ResaleOf = original
+		resold[original] = true
+		sales[reservationID] = &sale
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range reports {
+		report := &reports[i]
+		report.SaleType = saleTypePrimary
+		if sale, ok := sales[report.ReservationID]; ok {
+			report.SaleType = saleTypeResale
+			report.ResalePrice = sale.Price
+			report.ResaleOf = sale.ResaleOf
+			report.ResaleFee = sale.Fee
+		}
+		if resold[report.ReservationID] && report.SaleType == saleTypePrimary {
+			report.SaleType = saleTypeResold
+		}
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"database/sql"
+	"time"
+
+	"github.com/labstack/echo"
+)
 
 type Reservation struct {
 	ID         int64      `json:"id"`
@@ -16,4 +21,33 @@ type Reservation struct {
 	Price          int64  `json:"price,omitempty"`
 	ReservedAtUnix int64  `json:"reserved_at,omitempty"`
 	CanceledAtUnix int64  `json:"canceled_at,omitempty"`
+	TicketURL      string `json:"ticket_url,omitempty"`
+}
+
+// cancelReservation ends an active reservation: its resale listing and pending
+// transfers are closed, and the holder and webhooks are told. The caller must
+// hold the lock on the reservation row and have checked that it can be
+// canceled.
+func cancelReservation(tx *sql.Tx, c echo.Context, reservation *Reservation, event *Event, sheet *Sheet) error {
+	canceledAt := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", canceledAt, reservation.ID); err != nil {
+		return err
+	}
+	if err := withdrawResaleListings(tx, reservation.ID); err != nil {
+		return err
+	}
+	if err := closePendingTransfers(tx, reservation.ID); err != nil {
+		return err
+	}
+	if err := writeAuditLog(tx, c, "reservation.cancel", "reservation", reservation.ID,
+		echo.Map{"event_id": event.ID, "sheet_rank": sheet.Rank, "sheet_num": sheet.Num, "user_id": reservation.UserID, "canceled_at": nil},
+		echo.Map{"event_id": event.ID, "sheet_rank": sheet.Rank, "sheet_num": sheet.Num, "user_id": reservation.UserID, "canceled_at": canceledAt}); err != nil {
+		return err
+	}
+	if err := enqueueNotification(tx, reservation.UserID, notificationReservationCanceled, map[string]interface{}{
+		"Title": event.Title, "SheetRank": sheet.Rank, "SheetNum": sheet.Num,
+	}); err != nil {
+		return err
+	}
+	return enqueueWebhookEvent(tx, webhookReservationCanceled, echo.Map{"reservation_id": reservation.ID, "event_id": event.ID, "user_id": reservation.UserID, "sheet_rank": sheet.Rank, "sheet_num": sheet.Num, "canceled_at": canceledAt})
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	reservationHistoryDefaultLimit = 20
+	reservationHistoryMaxLimit     = 100
+)
+
+// reservationCursor points right after the last item of a page. It is passed to
+// clients as an opaque string.
+type reservationCursor struct {
+	ReservedAt time.Time
+	ID         int64
+}
+
+func (c reservationCursor) String() string {
+	raw := strconv.FormatInt(c.ReservedAt.UnixNano(), 10) + ":" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseReservationCursor(s string) (*reservationCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &reservationCursor{ReservedAt: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+// getReservationHistoryHandler lists the reservations of the logged in user.
+//
+// Query parameters:
+//
+//	status    active | canceled (default: both)
+//	event_id  only reservations of the event
+//	since     reserved at or after (unix time)
+//	until     reserved before (unix time)
+//	sort      -reserved_at (default) | reserved_at
+//	cursor    next_cursor of the previous page
+//	limit     page size (default 20, max 100)
+func getReservationHistoryHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+
+	conds := []string{"r.user_id = ?"}
+	args := []interface{}{loginUser.ID}
+
+	switch c.QueryParam("status") {
+	case "":
+	case "active":
+		conds = append(conds, "r.canceled_at IS NULL")
+	case "canceled":
+		conds = append(conds, "r.canceled_at IS NOT NULL")
+	default:
+		return validationError("invalid_status")
+	}
+	if v := c.QueryParam("event_id"); v != "" {
+		eventID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return validationError("invalid_event_id")
+		}
+		conds = append(conds, "r.event_id = ?")
+		args = append(args, eventID)
+	}
+	for _, key := range []string{"since", "until"} {
+		v := c.QueryParam(key)
+		if v == "" {
+			continue
+		}
+		t, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return validationError("invalid_" + key)
+		}
+		if key == "since" {
+			conds = append(conds, "r.reserved_at >= ?")
+		} else {
+			conds = append(conds, "r.reserved_at < ?")
+		}
+		args = append(args, time.Unix(t, 0).UTC())
+	}
+
+	order, cmp := "DESC", "<"
+	switch c.QueryParam("sort") {
+	case "", "-reserved_at":
+	case "reserved_at":
+		order, cmp = "ASC", ">"
+	default:
+		return validationError("invalid_sort")
+	}
+
+	if v := c.QueryParam("cursor"); v != "" {
+		cursor, err := parseReservationCursor(v)
+		if err != nil {
+			return validationError("invalid_cursor")
+		}
+		conds = append(conds, "(r.reserved_at "+cmp+" ? OR (r.reserved_at = ? AND r.id "+cmp+" ?))")
+		args = append(args, cursor.ReservedAt, cursor.ReservedAt, cursor.ID)
+	}
+
+	limit := reservationHistoryDefaultLimit
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > reservationHistoryMaxLimit {
+			return validationError("invalid_limit")
+		}
+	}
+
+	query := "SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, s.`rank`, s.num, s.price, e.title, e.price" +
+		" FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id" +
+		" WHERE " + strings.Join(conds, " AND ") +
+		" ORDER BY r.reserved_at " + order + ", r.id " + order +
+		" LIMIT " + strconv.Itoa(limit+1)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	reservations := make([]Reservation, 0, limit)
+	for rows.Next() {
+		var reservation Reservation
+		var sheet Sheet
+		var event Event
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num, &sheet.Price, &event.Title, &event.Price); err != nil {
+			return err
+		}
+		event.ID = reservation.EventID
+
+		reservation.Event = &event
+		reservation.SheetRank = sheet.Rank
+		reservation.SheetNum = sheet.Num
+		reservation.Price = event.Price + sheet.Price
+		reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
+		if reservation.CanceledAt != nil {
+			reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
+		} else {
+			reservation.TicketURL = reservationTicketURL(reservation.UserID, reservation.ID)
+		}
+		reservations = append(reservations, reservation)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var nextCursor string
+	if len(reservations) > limit {
+		reservations = reservations[:limit]
+		last := reservations[limit-1]
+		nextCursor = reservationCursor{ReservedAt: *last.ReservedAt, ID: last.ID}.String()
+	}
+	for i := range reservations {
+		reservations[i].Event.Price = 0
+	}
+
+	return c.JSON(200, echo.Map{
+		"reservations": reservations,
+		"next_cursor":  nextCursor,
+	})
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	saleAccessOpen      = "open"
+	saleAccessAllowlist = "allowlist"
+	saleAccessGroup     = "group"
+	saleAccessCode      = "code"
+
+	salePhaseGeneral    = "general"
+	salePhasePresale    = "presale"
+	salePhaseNotStarted = "not_started"
+	salePhaseEnded      = "ended"
+
+	saleMemberAllowlist = "allowlist"
+	saleMemberCode      = "code"
+
+	// saleAccessCodeMinLength keeps access codes long enough that the login
+	// guard's lockout makes guessing them impractical.
+	saleAccessCodeMinLength = 8
+)
+
+// SalePhase is a window in which an event can be reserved by the users its
+// access rule admits: everybody (open), users on the phase allowlist, members
+// of a group, or users who redeemed the access code. An event without phases
+// is on general sale all the time.
+type SalePhase struct {
+	ID       int64      `json:"id"`
+	EventID  int64      `json:"event_id"`
+	Name     string     `json:"name"`
+	StartsAt time.Time  `json:"-"`
+	EndsAt   *time.Time `json:"-"`
+	Access   string     `json:"access"`
+	Group    string     `json:"group,omitempty"`
+	HasCode  bool       `json:"has_code,omitempty"`
+
+	StartsAtUnix int64 `json:"starts_at"`
+	EndsAtUnix   int64 `json:"ends_at,omitempty"`
+}
+
+// SaleStatus tells the client which phase is active and whether the current
+// user may reserve in it.
+type SaleStatus struct {
+	Phase    string `json:"phase"`
+	Name     string `json:"name,omitempty"`
+	Access   string `json:"access,omitempty"`
+	Eligible bool   `json:"eligible"`
+
+	EndsAtUnix        int64  `json:"ends_at,omitempty"`
+	NextPhaseStartsAt int64  `json:"next_phase_starts_at,omitempty"`
+	NextPhaseName     string `json:"next_phase_name,omitempty"`
+}
+
+func (p *SalePhase) activeAt(now time.Time) bool {
+	return !now.Before(p.StartsAt) && (p.EndsAt == nil || now.Before(*p.EndsAt))
+}
+
+func getSalePhases(eventID int64) ([]*SalePhase, error) {
+	rows, err := db.Query("SELECT id, event_id, name, starts_at, ends_at, access, group_name, access_code_hash <> '' FROM event_sale_phases WHERE event_id = ? ORDER BY starts_at, id", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	phases := []*SalePhase{}
+	for rows.Next() {
+		var phase SalePhase
+		if err := rows.Scan(&phase.ID, &phase.EventID, &phase.Name, &phase.StartsAt, &phase.EndsAt, &phase.Access, &phase.Group, &phase.HasCode); err != nil {
+			return nil, err
+		}
+		phase.StartsAtUnix = phase.StartsAt.Unix()
+		if phase.EndsAt != nil {
+			phase.EndsAtUnix = phase.EndsAt.Unix()
+		}
+		phases = append(phases, &phase)
+	}
+	return phases, rows.Err()
+}
+
+// activeSalePhase returns the phase active at now; when phases overlap the one
+// that started last wins. nil means no phase is active.
+func activeSalePhase(phases []*SalePhase, now time.Time) *SalePhase {
+	var active *SalePhase
+	for _, phase := range phases {
+		if phase.activeAt(now) {
+			active = phase
+		}
+	}
+	return active
+}
+
+// eligibleForSalePhase reports whether the user may reserve in the phase.
+// userID is -1 for guests, who are only eligible for open phases.
+func eligibleForSalePhase(phase *SalePhase, userID int64) (bool, error) {
+	if phase.Access == saleAccessOpen {
+		return true, nil
+	}
+	if userID <= 0 {
+		return false, nil
+	}
+	var n int
+	var err error
+	switch phase.Access {
+	case saleAccessGroup:
+		err = db.QueryRow("SELECT COUNT(*) FROM user_groups WHERE user_id = ? AND group_name = ?", userID, phase.Group).Scan(&n)
+	default:
+		err = db.QueryRow("SELECT COUNT(*) FROM sale_phase_members WHERE phase_id = ? AND user_id = ?", phase.ID, userID).Scan(&n)
+	}
+	return n > 0, err
+}
+
+// getSaleStatus describes the sale of the event for the user at now.
+func getSaleStatus(eventID, userID int64, now time.Time) (*SaleStatus, error) {
+	phases, err := getSalePhases(eventID)
+	if err != nil {
+		return nil, err
+	}
+	if len(phases) == 0 {
+		return &SaleStatus{Phase: salePhaseGeneral, Access: saleAccessOpen, Eligible: true}, nil
+	}
+
+	status := &SaleStatus{}
+	for _, phase := range phases {
+		if phase.StartsAt.After(now) {
+			status.NextPhaseStartsAt = phase.StartsAtUnix
+			status.NextPhaseName = phase.Name
+			break
+		}
+	}
+
+	active := activeSalePhase(phases, now)
+	if active == nil {
+		status.Phase = salePhaseEnded
+		if status.NextPhaseStartsAt != 0 {
+			status.Phase = salePhaseNotStarted
+		}
+		return status, nil
+	}
+
+	status.Phase = salePhasePresale
+	if active.Access == saleAccessOpen {
+		status.Phase = salePhaseGeneral
+	}
+	status.Name = active.Name
+	status.Access = active.Access
+	status.EndsAtUnix = active.EndsAtUnix
+	status.Eligible, err = eligibleForSalePhase(active, userID)
+	return status, err
+}
+
+// checkSalePhase rejects reservations outside of an active phase or by users
+// the active phase does not admit.
+func checkSalePhase(eventID, userID int64) error {
+	status, err := getSaleStatus(eventID, userID, time.Now())
+	if err != nil {
+		return err
+	}
+	if status.Phase == salePhaseNotStarted || status.Phase == salePhaseEnded {
+		return forbiddenError("not_on_sale")
+	}
+	if !status.Eligible {
+		return forbiddenError("presale_not_eligible")
+	}
+	return nil
+}
+
+// redeemAccessCodeHandler grants the logged in user access to the code phases
+// of the event whose code matches.
+func redeemAccessCodeHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params struct {
+		Code string `json:"code" validate:"required,max=64,charset=printable"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	// 外れたコードはログインと同じ仕組みでユーザーと IP ごとに数える
+	guardKey := "user:" + strconv.FormatInt(user.ID, 10)
+	if ok, err := checkLogin(c, loginScopeAccessCode, guardKey); !ok {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT id FROM event_sale_phases WHERE event_id = ? AND access = ? AND access_code_hash = SHA2(?, 256)", eventID, saleAccessCode, params.Code)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var phaseIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		phaseIDs = append(phaseIDs, id)
+	}
+	rows.Close()
+	if len(phaseIDs) == 0 {
+		tx.Rollback()
+		return validationError("invalid_access_code")
+	}
+	for _, phaseID := range phaseIDs {
+		if _, err := tx.Exec("INSERT IGNORE INTO sale_phase_members (phase_id, user_id, source) VALUES (?, ?, ?)", phaseID, user.ID, saleMemberCode); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := writeAuditLog(tx, c, "sale_phase.redeem_code", "event", eventID, nil, echo.Map{"phase_ids": phaseIDs}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := recordLoginSuccess(c, loginScopeAccessCode, guardKey); err != nil {
+		return err
+	}
+
+	status, err := getSaleStatus(eventID, user.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, status)
+}
+
+type salePhaseParams struct {
+	Name       string `json:"name" validate:"required,max=64,charset=printable"`
+	StartsAt   int64  `json:"starts_at" validate:"min=1"`
+	EndsAt     int64  `json:"ends_at" validate:"min=0"`
+	Access     string `json:"access" validate:"required,oneof=open|allowlist|group|code"`
+	Group      string `json:"group" validate:"max=64,charset=loginname"`
+	AccessCode string `json:"access_code" validate:"max=64,charset=printable"`
+}
+
+// validate checks the rules that span fields. requireCode is set for new
+// phases; an existing code phase keeps its code when none is given.
+func (p *salePhaseParams) validate(requireCode bool) error {
+	var fields []FieldError
+	if p.EndsAt != 0 && p.EndsAt <= p.StartsAt {
+		fields = append(fields, FieldError{Field: "ends_at", Code: "out_of_range", Message: "must be after starts_at"})
+	}
+	if p.Access == saleAccessGroup && p.Group == "" {
+		fields = append(fields, FieldError{Field: "group", Code: "required", Message: "is required for group access"})
+	}
+	if p.Access == saleAccessCode && requireCode && p.AccessCode == "" {
+		fields = append(fields, FieldError{Field: "access_code", Code: "required", Message: "is required for code access"})
+	}
+	if p.AccessCode != "" && utf8.RuneCountInString(p.AccessCode) < saleAccessCodeMinLength {
+		fields = append(fields, FieldError{Field: "access_code", Code: "too_small", Message: fmt.Sprintf("must be at least %d characters", saleAccessCodeMinLength)})
+	}
+	if fields != nil {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+	return nil
+}
+
+func (p *salePhaseParams) times() (time.Time, *time.Time) {
+	startsAt := time.Unix(p.StartsAt, 0).UTC()
+	if p.EndsAt == 0 {
+		return startsAt, nil
+	}
+	endsAt := time.Unix(p.EndsAt, 0).UTC()
+	return startsAt, &endsAt
+}
+
+func salePhaseIDs(c echo.Context) (int64, int64, error) {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, 0, notFoundError("not_found")
+	}
+	phaseID, err := strconv.ParseInt(c.Param("phase_id"), 10, 64)
+	if err != nil {
+		return 0, 0, notFoundError("sale_phase_not_found")
+	}
+	return eventID, phaseID, nil
+}
+
+func getSalePhase(q queryRower, eventID, phaseID int64) (*SalePhase, error) {
+	var phase SalePhase
+	err := q.QueryRow("SELECT id, event_id, name, starts_at, ends_at, access, group_name, access_code_hash <> '' FROM event_sale_phases WHERE id = ? AND event_id = ?", phaseID, eventID).
+		Scan(&phase.ID, &phase.EventID, &phase.Name, &phase.StartsAt, &phase.EndsAt, &phase.Access, &phase.Group, &phase.HasCode)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("sale_phase_not_found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	phase.StartsAtUnix = phase.StartsAt.Unix()
+	if phase.EndsAt != nil {
+		phase.EndsAtUnix = phase.EndsAt.Unix()
+	}
+	return &phase, nil
+}
+
+func getSalePhasesHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	phases, err := getSalePhases(eventID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, phases)
+}
+
+func postSalePhasesHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params salePhaseParams
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	if err := params.validate(true); err != nil {
+		return err
+	}
+	if _, err := getEvent(eventID, -1); err != nil {
+		return err
+	}
+
+	startsAt, endsAt := params.times()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO event_sale_phases (event_id, name, starts_at, ends_at, access, group_name, access_code_hash) VALUES (?, ?, ?, ?, ?, ?, IF(? = '', '', SHA2(?, 256)))",
+		eventID, params.Name, startsAt, endsAt, params.Access, params.Group, params.AccessCode, params.AccessCode)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	phaseID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	phase, err := getSalePhase(tx, eventID, phaseID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "sale_phase.create", "event", eventID, nil, phase); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(201, phase)
+}
+
+// editSalePhaseHandler replaces the settings of a phase. An empty access_code
+// keeps the current code.
+func editSalePhaseHandler(c echo.Context) error {
+	eventID, phaseID, err := salePhaseIDs(c)
+	if err != nil {
+		return err
+	}
+	var params salePhaseParams
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	before, err := getSalePhase(tx, eventID, phaseID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := params.validate(!before.HasCode); err != nil {
+		tx.Rollback()
+		return err
+	}
+	startsAt, endsAt := params.times()
+	if _, err := tx.Exec("UPDATE event_sale_phases SET name = ?, starts_at = ?, ends_at = ?, access = ?, group_name = ?, access_code_hash = IF(? = '', access_code_hash, SHA2(?, 256)) WHERE id = ?",
+		params.Name, startsAt, endsAt, params.Access, params.Group, params.AccessCode, params.AccessCode, phaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	phase, err := getSalePhase(tx, eventID, phaseID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "sale_phase.edit", "event", eventID, before, phase); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, phase)
+}
+
+func deleteSalePhaseHandler(c echo.Context) error {
+	eventID, phaseID, err := salePhaseIDs(c)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	before, err := getSalePhase(tx, eventID, phaseID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, query := range []string{"DELETE FROM sale_phase_members WHERE phase_id = ?", "DELETE FROM event_sale_phases WHERE id = ?"} {
+		if _, err := tx.Exec(query, phaseID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := writeAuditLog(tx, c, "sale_phase.delete", "event", eventID, before, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
+
+// editSalePhaseUsersHandler adds (add true) or removes users of the allowlist
+// of a phase. Users who redeemed a code are not affected by removal.
+func editSalePhaseUsersHandler(add bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		eventID, phaseID, err := salePhaseIDs(c)
+		if err != nil {
+			return err
+		}
+		var params struct {
+			UserIDs []int64 `json:"user_ids"`
+		}
+		if err := bindParams(c, &params); err != nil {
+			return err
+		}
+		if len(params.UserIDs) == 0 || len(params.UserIDs) > 1000 {
+			return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: []FieldError{{Field: "user_ids", Code: "out_of_range", Message: "must have 1 to 1000 items"}}}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := getSalePhase(tx, eventID, phaseID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		action := "sale_phase.remove_users"
+		for _, userID := range params.UserIDs {
+			if add {
+				_, err = tx.Exec("INSERT IGNORE INTO sale_phase_members (phase_id, user_id, source) SELECT ?, id, ? FROM users WHERE id = ?", phaseID, saleMemberAllowlist, userID)
+			} else {
+				_, err = tx.Exec("DELETE FROM sale_phase_members WHERE phase_id = ? AND user_id = ? AND source = ?", phaseID, userID, saleMemberAllowlist)
+			}
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if add {
+			action = "sale_phase.add_users"
+		}
+		if err := writeAuditLog(tx, c, action, "event", eventID, nil, echo.Map{"phase_id": phaseID, "user_ids": params.UserIDs}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return c.NoContent(204)
+	}
+}
+
+// editUserGroupsHandler replaces the groups (memberships) of a user.
+func editUserGroupsHandler(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("user_not_found")
+	}
+	var params struct {
+		Groups []string `json:"groups"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	var fields []FieldError
+	groups := []string{}
+	for i, group := range params.Groups {
+		if group == "" || len(group) > 64 || !matchCharset(group, "loginname") {
+			fields = append(fields, FieldError{Field: "groups[" + strconv.Itoa(i) + "]", Code: "invalid_charset", Message: "must be 1 to 64 letters, digits, '_', '-' or '.'"})
+			continue
+		}
+		if !containsString(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	if fields != nil {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+	sort.Strings(groups)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("user_not_found")
+		}
+		return err
+	}
+	rows, err := tx.Query("SELECT group_name FROM user_groups WHERE user_id = ? ORDER BY group_name", userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	before := []string{}
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		before = append(before, group)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM user_groups WHERE user_id = ?", userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, group := range groups {
+		if _, err := tx.Exec("INSERT INTO user_groups (user_id, group_name) VALUES (?, ?)", userID, group); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := writeAuditLog(tx, c, "user.edit_groups", "user", userID, before, groups); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{"user_id": userID, "groups": groups})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	saleTypeChange  = "change"
+	saleTypeChanged = "changed"
+)
+
+// SeatChange is the result of exchanging a reservation for another sheet of
+// the same event. The old reservation is ended and a new one is made in the
+// same transaction, so the user never ends up without a seat.
+type SeatChange struct {
+	ReservationID         int64  `json:"id"`
+	SheetRank             string `json:"sheet_rank"`
+	SheetNum              int64  `json:"sheet_num"`
+	Price                 int64  `json:"price"`
+	PreviousReservationID int64  `json:"previous_id"`
+	PreviousSheetRank     string `json:"previous_sheet_rank"`
+	PreviousSheetNum      int64  `json:"previous_sheet_num"`
+	PreviousPrice         int64  `json:"previous_price"`
+	PriceDifference       int64  `json:"price_difference"`
+}
+
+// reservationPrice is the price of the reservation as it appears in the sales
+// report: the resale price when it was bought on the resale market, otherwise
+// the face value.
+func reservationPrice(tx *sql.Tx, reservationID, facePrice int64) (int64, error) {
+	var price int64
+	err := tx.QueryRow("SELECT price FROM resale_sales WHERE reservation_id = ?", reservationID).Scan(&price)
+	if err == sql.ErrNoRows {
+		return facePrice, nil
+	}
+	return price, err
+}
+
+// lockFreeSheet locks the reservations index of the sheet and reports whether
+// it is free, so that concurrent reservations of the sheet wait for the swap.
+func lockFreeSheet(tx *sql.Tx, eventID, sheetID int64) (bool, error) {
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL FOR UPDATE", eventID, sheetID).Scan(&n); err != nil {
+		return false, err
+	}
+	return n == 0, nil
+}
+
+// changeSeatHandler swaps an active reservation of the logged in user for a
+// sheet of sheet_rank (the current rank when omitted). sheet_num picks the
+// sheet; when omitted a free sheet is chosen at random. The price difference
+// is the new face value minus the price of the current reservation.
+func changeSeatHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	reservationID, err := strconv.ParseInt(c.Param("reservation_id"), 10, 64)
+	if err != nil {
+		return notFoundError("reservation_not_found")
+	}
+	var params struct {
+		Rank string `json:"sheet_rank"`
+		Num  int64  `json:"sheet_num" validate:"min=0,max=1000"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	var eventID, oldSheetID int64
+	if err := db.QueryRow("SELECT event_id, sheet_id FROM reservations WHERE id = ? AND user_id = ? AND canceled_at IS NULL", reservationID, loginUser.ID).Scan(&eventID, &oldSheetID); err != nil {
+		if err == sql.ErrNoRows {
+			return notFoundError("reservation_not_found")
+		}
+		return err
+	}
+	event, err := getEvent(eventID, loginUser.ID)
+	if err != nil {
+		return err
+	}
+	if !event.PublicFg {
+		return notFoundError("invalid_event")
+	}
+	oldSheet, _ := getSheetByID(oldSheetID)
+	if oldSheet == nil {
+		return notFoundError("invalid_sheet")
+	}
+	if params.Rank == "" {
+		params.Rank = oldSheet.Rank
+	}
+	if !validateRank(params.Rank) {
+		return validationError("invalid_rank")
+	}
+	if err := checkSalePhase(event.ID, loginUser.ID); err != nil {
+		return err
+	}
+	if err := checkLotterySale(event.ID); err != nil {
+		return err
+	}
+	ticketID, err := requireQueueAdmission(c, event.ID, loginUser.ID)
+	if err != nil {
+		return err
+	}
+
+	var candidates []Sheet
+	if params.Num != 0 {
+		var sheet Sheet
+		if err := db.QueryRow("SELECT * FROM sheets WHERE `rank` = ? AND num = ?", params.Rank, params.Num).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
+			if err == sql.ErrNoRows {
+				return notFoundError("invalid_sheet")
+			}
+			return err
+		}
+		if sheet.ID == oldSheetID {
+			return validationError("same_sheet")
+		}
+		candidates = append(candidates, sheet)
+	} else {
+		rows, err := db.Query("SELECT * FROM sheets WHERE id NOT IN (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL) AND `rank` = ?", event.ID, params.Rank)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var sheet Sheet
+			if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
+				rows.Close()
+				return err
+			}
+			candidates = append(candidates, sheet)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(candidates) == 0 {
+			return soldOutError()
+		}
+		rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var closed bool
+	if err := tx.QueryRow("SELECT e.closed_fg FROM reservations r INNER JOIN events e ON e.id = r.event_id WHERE r.id = ? AND r.user_id = ? AND r.canceled_at IS NULL FOR UPDATE", reservationID, loginUser.ID).Scan(&closed); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("reservation_not_found")
+		}
+		return err
+	}
+	if closed {
+		tx.Rollback()
+		return conflictError("event_closed")
+	}
+	var checkedIn, transfers, listed int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM checkins WHERE reservation_id = ?", reservationID).Scan(&checkedIn); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if checkedIn > 0 {
+		tx.Rollback()
+		return conflictError("already_checked_in")
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM ticket_transfers WHERE reservation_id = ? AND status = ? AND expires_at > ?", reservationID, transferStatusPending, time.Now().UTC()).Scan(&transfers); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if transfers > 0 {
+		tx.Rollback()
+		return conflictError("transfer_pending")
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM resale_listings WHERE reservation_id = ? AND status = ?", reservationID, resaleStatusActive).Scan(&listed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if listed > 0 {
+		tx.Rollback()
+		return conflictError("already_listed")
+	}
+
+	var sheet *Sheet
+	for i := range candidates {
+		free, err := lockFreeSheet(tx, event.ID, candidates[i].ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if free {
+			sheet = &candidates[i]
+			break
+		}
+	}
+	if sheet == nil {
+		tx.Rollback()
+		if params.Num != 0 {
+			return conflictError("sheet_reserved")
+		}
+		return soldOutError()
+	}
+
+	// 旧予約を先に終えてから数えるので、交換で上限に引っかかることはない
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", now, reservationID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := checkPurchaseLimits(tx, loginUser.ID, event.ID, sheet.Rank); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := useQueueAdmission(tx, ticketID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?)", event.ID, sheet.ID, loginUser.ID, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	newReservationID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	previousPrice, err := reservationPrice(tx, reservationID, event.Price+oldSheet.Price)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	change := &SeatChange{
+		ReservationID:         newReservationID,
+		SheetRank:             sheet.Rank,
+		SheetNum:              sheet.Num,
+		Price:                 event.Price + sheet.Price,
+		PreviousReservationID: reservationID,
+		PreviousSheetRank:     oldSheet.Rank,
+		PreviousSheetNum:      oldSheet.Num,
+		PreviousPrice:         previousPrice,
+	}
+	change.PriceDifference = change.Price - change.PreviousPrice
+	if _, err := tx.Exec("INSERT INTO seat_changes (event_id, user_id, original_reservation_id, reservation_id, previous_price, price, price_difference, changed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		event.ID, loginUser.ID, reservationID, newReservationID, change.PreviousPrice, change.Price, change.PriceDifference, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := writeAuditLog(tx, c, "reservation.change_seat", "reservation", newReservationID,
+		echo.Map{"reservation_id": reservationID, "event_id": event.ID, "sheet_rank": oldSheet.Rank, "sheet_num": oldSheet.Num, "price": change.PreviousPrice},
+		echo.Map{"reservation_id": newReservationID, "event_id": event.ID, "sheet_rank": sheet.Rank, "sheet_num": sheet.Num, "price": change.Price, "price_difference": change.PriceDifference}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueNotification(tx, loginUser.ID, notificationSeatChanged, map[string]interface{}{
+		"Title": event.Title, "SheetRank": sheet.Rank, "SheetNum": sheet.Num, "PreviousSheetRank": oldSheet.Rank, "PreviousSheetNum": oldSheet.Num,
+		"PriceDifference": change.PriceDifference, "ReservationID": newReservationID,
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueWebhookEvent(tx, webhookReservationSeatChanged, echo.Map{"reservation_id": newReservationID, "previous_reservation_id": reservationID, "event_id": event.ID, "user_id": loginUser.ID,
+		"sheet_rank": sheet.Rank, "sheet_num": sheet.Num, "previous_sheet_rank": oldSheet.Rank, "previous_sheet_num": oldSheet.Num, "price": change.Price, "price_difference": change.PriceDifference}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(202, change)
+}
+
+type seatChange struct {
+	ChangeOf        int64
+	PriceDifference int64
+}
+
+// applySeatChanges marks reservations made by a seat change as "change" with
+// the reservation they replaced and the price difference, and primary
+// reservations given up in a change as "changed" (their canceled_at is the
+// time of the change). eventID 0 means all events.
+func applySeatChanges(reports []Report, eventID int64) error {
+	query := "SELECT original_reservation_id, reservation_id, price_difference FROM seat_changes"
+	var args []interface{}
+	if eventID != 0 {
+		query += " WHERE event_id = ?"
+		args = append(args, eventID)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	changed := map[int64]bool{}
+	changes := map[int64]*seatChange{}
+	for rows.Next() {
+		var reservationID int64
+		var change seatChange
+		if err := rows.Scan(&change.ChangeOf, &reservationID, &change.PriceDifference); err != nil {
+			return err
+		}
+		changed[change.ChangeOf] = true
+		changes[reservationID] = &change
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range reports {
+		report := &reports[i]
+		if change, ok := changes[report.ReservationID]; ok {
+			report.SaleType = saleTypeChange
+			report.ChangeOf = change.ChangeOf
+			report.PriceDifference = change.PriceDifference
+		} else if changed[report.ReservationID] && report.SaleType == saleTypePrimary {
+			report.SaleType = saleTypeChanged
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strings"
+)
+
+// signingKey signs tokens handed out to clients (queue tickets and the like).
+// Set SIGNING_KEY when running several instances so that they accept each
+// other's tokens; otherwise a random key is generated at startup.
+var signingKey []byte
+
+// signingKeyPersistent is false while the random key is in use. Tokens that
+// must outlive the process, such as tickets, are not issued then.
+var signingKeyPersistent bool
+
+func initSigningKey(key string) {
+	if key != "" {
+		signingKey = []byte(key)
+		signingKeyPersistent = true
+		return
+	}
+	signingKey = make([]byte, 32)
+	if _, err := rand.Read(signingKey); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("SIGNING_KEY is not set; tokens signed by this process are only valid until it restarts and tickets are disabled")
+}
+
+func signature(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(purpose + "\x00" + payload))
+	return mac.Sum(nil)
+}
+
+// signToken returns "payload.signature" in URL-safe base64. purpose keeps a
+// token issued for one use from being accepted for another.
+func signToken(purpose, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(signature(purpose, payload))
+}
+
+// verifyToken returns the payload of a token made by signToken for purpose.
+func verifyToken(purpose, token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(sig, signature(purpose, string(payload))) {
+		return "", false
+	}
+	return string(payload), true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	ticketTokenPurpose = "ticket"
+	ticketQRScale      = 8
+)
+
+// Ticket is the digital ticket of an active reservation. Token is signed with
+// the signing key, so it cannot be forged or altered, and it is only accepted
+// while the reservation is active and held by the user it was issued to:
+// canceling or transferring the reservation invalidates it.
+type Ticket struct {
+	ReservationID int64  `json:"reservation_id"`
+	EventID       int64  `json:"event_id"`
+	SheetID       int64  `json:"-"`
+	UserID        int64  `json:"-"`
+	Title         string `json:"title"`
+	StartAtUnix   int64  `json:"start_at,omitempty"`
+	SheetRank     string `json:"sheet_rank"`
+	SheetNum      int64  `json:"sheet_num"`
+	Token         string `json:"token"`
+	QRPNGURL      string `json:"qr_png_url"`
+	QRSVGURL      string `json:"qr_svg_url"`
+}
+
+func reservationTicketURL(userID, reservationID int64) string {
+	return fmt.Sprintf("/api/users/%d/reservations/%d/ticket", userID, reservationID)
+}
+
+// ticketToken signs "reservation:event:sheet:user".
+func ticketToken(reservationID, eventID, sheetID, userID int64) string {
+	return signToken(ticketTokenPurpose, fmt.Sprintf("%d:%d:%d:%d", reservationID, eventID, sheetID, userID))
+}
+
+// parseTicketToken checks the signature and returns reservation, event, sheet
+// and user ids.
+func parseTicketToken(token string) (ids [4]int64, ok bool) {
+	payload, ok := verifyToken(ticketTokenPurpose, token)
+	if !ok {
+		return ids, false
+	}
+	parts := strings.Split(payload, ":")
+	if len(parts) != len(ids) {
+		return ids, false
+	}
+	for i, part := range parts {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return ids, false
+		}
+		ids[i] = id
+	}
+	return ids, true
+}
+
+// scanTicket reads a row of ticketQuery and returns canceled_at with it.
+func scanTicket(row rowScanner) (*Ticket, *time.Time, error) {
+	var ticket Ticket
+	var startAt, canceledAt *time.Time
+	if err := row.Scan(&ticket.ReservationID, &ticket.EventID, &ticket.SheetID, &ticket.UserID, &canceledAt, &ticket.Title, &startAt, &ticket.SheetRank, &ticket.SheetNum); err != nil {
+		return nil, nil, err
+	}
+	if startAt != nil {
+		ticket.StartAtUnix = startAt.Unix()
+	}
+	return &ticket, canceledAt, nil
+}
+
+const ticketQuery = "SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.canceled_at, e.title, e.start_at, s.`rank`, s.num" +
+	" FROM reservations r INNER JOIN events e ON e.id = r.event_id INNER JOIN sheets s ON s.id = r.sheet_id"
+
+// verifyTicket resolves a ticket token to its reservation. It fails with
+// invalid_ticket for forged or unknown tokens, ticket_canceled when the
+// reservation has been canceled since the ticket was issued and
+// ticket_transferred when it has changed hands.
+func verifyTicket(q queryRower, token string) (*Ticket, error) {
+	ids, ok := parseTicketToken(token)
+	if !ok {
+		return nil, validationError("invalid_ticket")
+	}
+	ticket, canceledAt, err := scanTicket(q.QueryRow(ticketQuery+" WHERE r.id = ?", ids[0]))
+	if err == sql.ErrNoRows {
+		return nil, validationError("invalid_ticket")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ticket.EventID != ids[1] || ticket.SheetID != ids[2] {
+		return nil, validationError("invalid_ticket")
+	}
+	if canceledAt != nil {
+		return nil, conflictError("ticket_canceled")
+	}
+	if ticket.UserID != ids[3] {
+		return nil, conflictError("ticket_transferred")
+	}
+	ticket.Token = token
+	return ticket, nil
+}
+
+// requireTicketSigningKey fails with ticket_signing_key_not_set unless
+// SIGNING_KEY is configured: a ticket signed with a random key would stop
+// working at the gate after a restart or on another instance.
+func requireTicketSigningKey() error {
+	if !signingKeyPersistent {
+		return serviceUnavailableError("ticket_signing_key_not_set")
+	}
+	return nil
+}
+
+// ownTicket loads the ticket of :reservation_id for the logged in owner. Only
+// active reservations have a ticket.
+func ownTicket(c echo.Context) (*Ticket, error) {
+	if err := requireTicketSigningKey(); err != nil {
+		return nil, err
+	}
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return nil, err
+	}
+	reservationID, err := strconv.ParseInt(c.Param("reservation_id"), 10, 64)
+	if err != nil {
+		return nil, notFoundError("ticket_not_found")
+	}
+	ticket, canceledAt, err := scanTicket(db.QueryRow(ticketQuery+" WHERE r.id = ? AND r.user_id = ?", reservationID, loginUser.ID))
+	if err == sql.ErrNoRows || (err == nil && canceledAt != nil) {
+		return nil, notFoundError("ticket_not_found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	ticket.Token = ticketToken(ticket.ReservationID, ticket.EventID, ticket.SheetID, ticket.UserID)
+	url := reservationTicketURL(loginUser.ID, ticket.ReservationID)
+	ticket.QRPNGURL = url + "/qr.png"
+	ticket.QRSVGURL = url + "/qr.svg"
+	return ticket, nil
+}
+
+func getTicketHandler(c echo.Context) error {
+	ticket, err := ownTicket(c)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "private, no-store")
+	return c.JSON(200, ticket)
+}
+
+// getTicketQRHandler renders the ticket token as a QR code in format "png" or
+// "svg". The image is served as an attachment so that it can be saved.
+func getTicketQRHandler(format string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ticket, err := ownTicket(c)
+		if err != nil {
+			return err
+		}
+		qr, err := encodeQR([]byte(ticket.Token))
+		if err != nil {
+			return err
+		}
+
+		var body []byte
+		contentType := "image/svg+xml"
+		if format == "png" {
+			contentType = "image/png"
+			if body, err = qr.PNG(ticketQRScale); err != nil {
+				return err
+			}
+		} else {
+			body = qr.SVG()
+		}
+		header := c.Response().Header()
+		header.Set("Cache-Control", "private, no-store")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="ticket-%d.%s"`, ticket.ReservationID, format))
+		return c.Blob(200, contentType, body)
+	}
+}
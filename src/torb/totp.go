@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// TOTP (RFC 6238) parameters compatible with common authenticator apps.
+const (
+	totpIssuer         = "Torb"
+	totpPeriod         = 30
+	totpDigits         = 6
+	totpSkew           = 1
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+var (
+	errTOTPNotEnrolled    = validationError("totp_not_enrolled")
+	errTOTPAlreadyEnabled = conflictError("totp_already_enabled")
+	errTOTPInvalidCode    = validationError("invalid_totp_code")
+	errTOTPRequired       = forbiddenError("totp_required_by_policy")
+)
+
+// totpModulus is 10^totpDigits.
+var totpModulus = func() uint32 {
+	m := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		m *= 10
+	}
+	return m
+}()
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpURI(secret, loginName string) string {
+	label := url.PathEscape(totpIssuer + ":" + loginName)
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%totpModulus)
+}
+
+// matchTOTP returns the time step the code belongs to, or -1 if it does not match
+// any step within the allowed clock skew.
+func matchTOTP(secret, code string, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+// verifyAdministratorTOTP checks a TOTP code and rejects codes that were already
+// used, so an observed code cannot be replayed within its validity window.
+func verifyAdministratorTOTP(tx *sql.Tx, administratorID int64, code string) error {
+	var secret string
+	var lastStep int64
+	if err := tx.QueryRow("SELECT totp_secret, totp_last_step FROM administrators WHERE id = ? FOR UPDATE", administratorID).Scan(&secret, &lastStep); err != nil {
+		if err == sql.ErrNoRows {
+			return errAdministratorNotFound
+		}
+		return err
+	}
+	if secret == "" {
+		return errTOTPNotEnrolled
+	}
+
+	step := matchTOTP(secret, code, time.Now())
+	if step < 0 || step <= lastStep {
+		return errTOTPInvalidCode
+	}
+	_, err := tx.Exec("UPDATE administrators SET totp_last_step = ? WHERE id = ?", step, administratorID)
+	return err
+}
+
+// useRecoveryCode consumes a single-use recovery code.
+func useRecoveryCode(tx *sql.Tx, administratorID int64, code string) error {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	res, err := tx.Exec("UPDATE administrator_recovery_codes SET used_at = ? WHERE administrator_id = ? AND code_hash = SHA2(?, 256) AND used_at IS NULL LIMIT 1",
+		time.Now().UTC().Format("2006-01-02 15:04:05.000000"), administratorID, code)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errTOTPInvalidCode
+	}
+	return nil
+}
+
+// verifyAdministratorSecondFactor accepts either a TOTP code or a recovery code.
+func verifyAdministratorSecondFactor(tx *sql.Tx, administratorID int64, code string) error {
+	if len(code) == totpDigits {
+		return verifyAdministratorTOTP(tx, administratorID, code)
+	}
+	return useRecoveryCode(tx, administratorID, code)
+}
+
+// regenerateRecoveryCodes replaces all recovery codes of the administrator and
+// returns the new plain codes. They are only stored hashed.
+func regenerateRecoveryCodes(tx *sql.Tx, administratorID int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength/2)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		codes[i] = hex.EncodeToString(b)
+	}
+
+	if _, err := tx.Exec("DELETE FROM administrator_recovery_codes WHERE administrator_id = ?", administratorID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO administrator_recovery_codes (administrator_id, code_hash) VALUES (?, SHA2(?, 256))", administratorID, code); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, code := range codes {
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+	}
+	return codes, nil
+}
+
+// enrollTOTPHandler issues a new (not yet enabled) secret for the logged in administrator.
+func enrollTOTPHandler(c echo.Context) error {
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+	if administrator.TOTPEnabled {
+		return errTOTPAlreadyEnabled
+	}
+	current, err := getAdministrator(administrator.ID)
+	if err != nil {
+		return err
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE administrators SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, administrator.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "administrator.totp_enroll", "administrator", administrator.ID, nil, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{
+		"secret":      secret,
+		"otpauth_uri": totpURI(secret, current.LoginName),
+	})
+}
+
+// activateTOTPHandler confirms the enrollment with a code from the authenticator
+// and hands out the recovery codes. They are never shown again.
+func activateTOTPHandler(c echo.Context) error {
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+	if administrator.TOTPEnabled {
+		return errTOTPAlreadyEnabled
+	}
+	var params struct {
+		Code string `json:"code" validate:"required,max=32"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	// ログインと同じ上限で数え、乗っ取られたセッションからの総当たりを防ぐ
+	if ok, err := checkLogin(c, loginScopeAdmin, administrator.LoginName); !ok {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := verifyAdministratorTOTP(tx, administrator.ID, params.Code); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE administrators SET totp_enabled_fg = 1 WHERE id = ?", administrator.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	codes, err := regenerateRecoveryCodes(tx, administrator.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "administrator.totp_activate", "administrator", administrator.ID, echo.Map{"totp_enabled": false}, echo.Map{"totp_enabled": true}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := recordLoginSuccess(c, loginScopeAdmin, administrator.LoginName); err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{"recovery_codes": codes})
+}
+
+func disableTOTPHandler(c echo.Context) error {
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+	if !administrator.TOTPEnabled {
+		return errTOTPNotEnrolled
+	}
+	if administrator.TOTPRequired {
+		return errTOTPRequired
+	}
+	var params struct {
+		Code string `json:"code" validate:"required,max=32"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	// ログインと同じ上限で数え、乗っ取られたセッションからの総当たりを防ぐ
+	if ok, err := checkLogin(c, loginScopeAdmin, administrator.LoginName); !ok {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := verifyAdministratorSecondFactor(tx, administrator.ID, params.Code); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := resetAdministratorTOTP(tx, administrator.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "administrator.totp_disable", "administrator", administrator.ID, echo.Map{"totp_enabled": true}, echo.Map{"totp_enabled": false}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := recordLoginSuccess(c, loginScopeAdmin, administrator.LoginName); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
+
+func regenerateRecoveryCodesHandler(c echo.Context) error {
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+	if !administrator.TOTPEnabled {
+		return errTOTPNotEnrolled
+	}
+	var params struct {
+		Code string `json:"code" validate:"required,max=32"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	// ログインと同じ上限で数え、乗っ取られたセッションからの総当たりを防ぐ
+	if ok, err := checkLogin(c, loginScopeAdmin, administrator.LoginName); !ok {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := verifyAdministratorTOTP(tx, administrator.ID, params.Code); err != nil {
+		tx.Rollback()
+		return err
+	}
+	codes, err := regenerateRecoveryCodes(tx, administrator.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "administrator.totp_recovery_codes", "administrator", administrator.ID, nil, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := recordLoginSuccess(c, loginScopeAdmin, administrator.LoginName); err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{"recovery_codes": codes})
+}
+
+func resetAdministratorTOTP(tx *sql.Tx, administratorID int64) error {
+	if _, err := tx.Exec("UPDATE administrators SET totp_secret = '', totp_enabled_fg = 0, totp_last_step = 0 WHERE id = ?", administratorID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM administrator_recovery_codes WHERE administrator_id = ?", administratorID)
+	return err
+}
+
+// changeTOTPPolicyHandler lets a superadmin require 2FA for an administrator or
+// reset the enrollment of an administrator who lost their device.
+func changeTOTPPolicyHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params struct {
+		Required bool `json:"required"`
+		Reset    bool `json:"reset"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var locked int64
+	if err := tx.QueryRow("SELECT id FROM administrators WHERE id = ? FOR UPDATE", id).Scan(&locked); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return errAdministratorNotFound
+		}
+		return err
+	}
+	current, err := loadAdministrator(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if params.Reset {
+		if err := resetAdministratorTOTP(tx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE administrators SET totp_required_fg = ? WHERE id = ?", params.Required, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	administrator, err := loadAdministrator(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "administrator.totp_policy", "administrator", id, current, administrator); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, administrator)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B. They are 8 digits long; with
+// totpDigits = 6 the code is the last six of them.
+var totpRFCVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+const totpRFCSecret = "12345678901234567890"
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range totpRFCVectors {
+		want := v.code[len(v.code)-totpDigits:]
+		if got := totpCode([]byte(totpRFCSecret), v.unix/totpPeriod); got != want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(totpRFCSecret))
+	for _, v := range totpRFCVectors {
+		code := v.code[len(v.code)-totpDigits:]
+		now := time.Unix(v.unix, 0)
+		step := v.unix / totpPeriod
+		if got := matchTOTP(secret, code, now); got != step {
+			t.Errorf("matchTOTP(T=%d) = %d, want %d", v.unix, got, step)
+		}
+		if got := matchTOTP(strings.ToLower(secret), code, now); got != step {
+			t.Errorf("matchTOTP(T=%d) with a lower case secret = %d, want %d", v.unix, got, step)
+		}
+		// 前後 totpSkew ステップまでは受け付け、それより離れると拒否する
+		if got := matchTOTP(secret, code, now.Add(totpSkew*totpPeriod*time.Second)); got != step {
+			t.Errorf("matchTOTP(T=%d) one step later = %d, want %d", v.unix, got, step)
+		}
+		if got := matchTOTP(secret, code, now.Add((totpSkew+1)*totpPeriod*time.Second)); got != -1 {
+			t.Errorf("matchTOTP(T=%d) two steps later = %d, want -1", v.unix, got)
+		}
+		if got := matchTOTP(secret, v.code, now); got != -1 {
+			t.Errorf("matchTOTP(T=%d) with 8 digits = %d, want -1", v.unix, got)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	transferStatusPending  = "pending"
+	transferStatusAccepted = "accepted"
+	transferStatusDeclined = "declined"
+	transferStatusCanceled = "canceled"
+	transferStatusExpired  = "expired"
+
+	transferTTL = 72 * time.Hour
+)
+
+// TicketTransfer hands a reservation from one user to another. The holder
+// offers it to a login name and the recipient accepts; only then does the
+// reservation change owner. Seat and price never change.
+type TicketTransfer struct {
+	ID            int64      `json:"id"`
+	ReservationID int64      `json:"reservation_id"`
+	EventID       int64      `json:"event_id"`
+	Title         string     `json:"title"`
+	SheetRank     string     `json:"sheet_rank"`
+	SheetNum      int64      `json:"sheet_num"`
+	FromUserID    int64      `json:"from_user_id"`
+	FromNickname  string     `json:"from_nickname"`
+	ToUserID      int64      `json:"to_user_id"`
+	ToNickname    string     `json:"to_nickname"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"-"`
+	ExpiresAt     time.Time  `json:"-"`
+	RespondedAt   *time.Time `json:"-"`
+
+	CreatedAtUnix   int64 `json:"created_at"`
+	ExpiresAtUnix   int64 `json:"expires_at"`
+	RespondedAtUnix int64 `json:"responded_at,omitempty"`
+}
+
+// TransferPolicy is set per event by administrators. Transfers are allowed
+// unless disabled.
+type TransferPolicy struct {
+	Enabled bool `json:"enabled"`
+}
+
+func getTransferPolicy(q queryRower, eventID int64) (*TransferPolicy, error) {
+	policy := &TransferPolicy{Enabled: true}
+	err := q.QueryRow("SELECT enabled FROM event_transfer_policies WHERE event_id = ?", eventID).Scan(&policy.Enabled)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return policy, nil
+}
+
+const transferQuery = "SELECT t.id, t.reservation_id, t.event_id, e.title, s.`rank`, s.num, t.from_user_id, fu.nickname, t.to_user_id, tu.nickname, t.status, t.created_at, t.expires_at, t.responded_at" +
+	" FROM ticket_transfers t INNER JOIN events e ON e.id = t.event_id INNER JOIN reservations r ON r.id = t.reservation_id INNER JOIN sheets s ON s.id = r.sheet_id" +
+	" INNER JOIN users fu ON fu.id = t.from_user_id INNER JOIN users tu ON tu.id = t.to_user_id"
+
+func scanTransfer(row rowScanner) (*TicketTransfer, error) {
+	var t TicketTransfer
+	if err := row.Scan(&t.ID, &t.ReservationID, &t.EventID, &t.Title, &t.SheetRank, &t.SheetNum, &t.FromUserID, &t.FromNickname, &t.ToUserID, &t.ToNickname, &t.Status, &t.CreatedAt, &t.ExpiresAt, &t.RespondedAt); err != nil {
+		return nil, err
+	}
+	if t.Status == transferStatusPending && !time.Now().Before(t.ExpiresAt) {
+		t.Status = transferStatusExpired
+	}
+	t.CreatedAtUnix = t.CreatedAt.Unix()
+	t.ExpiresAtUnix = t.ExpiresAt.Unix()
+	if t.RespondedAt != nil {
+		t.RespondedAtUnix = t.RespondedAt.Unix()
+	}
+	return &t, nil
+}
+
+func getTransfer(q queryRower, id int64) (*TicketTransfer, error) {
+	t, err := scanTransfer(q.QueryRow(transferQuery+" WHERE t.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("transfer_not_found")
+	}
+	return t, err
+}
+
+// postTransferHandler offers an active reservation of the logged in user to
+// another user.
+func postTransferHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	reservationID, err := strconv.ParseInt(c.Param("reservation_id"), 10, 64)
+	if err != nil {
+		return notFoundError("reservation_not_found")
+	}
+	var params struct {
+		ToLoginName string `json:"to_login_name" validate:"required,max=128,charset=loginname"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	var toUserID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE login_name = ? AND deleted_at IS NULL", params.ToLoginName).Scan(&toUserID); err != nil {
+		if err == sql.ErrNoRows {
+			return validationError("invalid_recipient")
+		}
+		return err
+	}
+	if toUserID == loginUser.ID {
+		return validationError("invalid_recipient")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var eventID int64
+	var closed bool
+	if err := tx.QueryRow("SELECT r.event_id, e.closed_fg FROM reservations r INNER JOIN events e ON e.id = r.event_id WHERE r.id = ? AND r.user_id = ? AND r.canceled_at IS NULL FOR UPDATE", reservationID, loginUser.ID).Scan(&eventID, &closed); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("reservation_not_found")
+		}
+		return err
+	}
+	if err := checkTransferable(tx, eventID, reservationID, closed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var pending int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM ticket_transfers WHERE reservation_id = ? AND status = ? AND expires_at > ?", reservationID, transferStatusPending, time.Now().UTC()).Scan(&pending); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if pending > 0 {
+		tx.Rollback()
+		return conflictError("transfer_pending")
+	}
+	var listed int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM resale_listings WHERE reservation_id = ? AND status = ?", reservationID, resaleStatusActive).Scan(&listed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if listed > 0 {
+		tx.Rollback()
+		return conflictError("already_listed")
+	}
+
+	now := time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO ticket_transfers (reservation_id, event_id, from_user_id, to_user_id, status, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		reservationID, eventID, loginUser.ID, toUserID, transferStatusPending, now, now.Add(transferTTL))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	transferID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	transfer, err := getTransfer(tx, transferID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "transfer.create", "reservation", reservationID, nil, transfer); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueNotification(tx, toUserID, notificationTransferRequested, map[string]interface{}{
+		"Title": transfer.Title, "SheetRank": transfer.SheetRank, "SheetNum": transfer.SheetNum, "From": transfer.FromNickname, "TransferID": transfer.ID,
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(201, transfer)
+}
+
+// checkTransferable rejects transfers of closed events, of events whose policy
+// disables them and of tickets that have been used.
+func checkTransferable(tx *sql.Tx, eventID, reservationID int64, closed bool) error {
+	if closed {
+		return conflictError("event_closed")
+	}
+	policy, err := getTransferPolicy(tx, eventID)
+	if err != nil {
+		return err
+	}
+	if !policy.Enabled {
+		return forbiddenError("transfer_disabled")
+	}
+	var checkedIn int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM checkins WHERE reservation_id = ?", reservationID).Scan(&checkedIn); err != nil {
+		return err
+	}
+	if checkedIn > 0 {
+		return conflictError("already_checked_in")
+	}
+	return nil
+}
+
+// closePendingTransfers cancels the pending transfers of a reservation that is
+// canceled by its holder.
+func closePendingTransfers(tx *sql.Tx, reservationID int64) error {
+	_, err := tx.Exec("UPDATE ticket_transfers SET status = ?, responded_at = ? WHERE reservation_id = ? AND status = ?", transferStatusCanceled, time.Now().UTC(), reservationID, transferStatusPending)
+	return err
+}
+
+// getTransfersHandler lists the transfers sent and received by the logged in
+// user, newest first.
+func getTransfersHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	rows, err := db.Query(transferQuery+" WHERE t.from_user_id = ? OR t.to_user_id = ? ORDER BY t.id DESC LIMIT 50", loginUser.ID, loginUser.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	transfers := []*TicketTransfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			return err
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, transfers)
+}
+
+// lockPendingTransfer locks the transfer for a response by the logged in user,
+// who must be the recipient (recipient true) or the sender.
+func lockPendingTransfer(c echo.Context, tx *sql.Tx, recipient bool) (*TicketTransfer, error) {
+	transferID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, notFoundError("transfer_not_found")
+	}
+	user, err := getLoginUser(c)
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM ticket_transfers WHERE id = ? FOR UPDATE", transferID).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFoundError("transfer_not_found")
+		}
+		return nil, err
+	}
+	transfer, err := getTransfer(tx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	if (recipient && transfer.ToUserID != user.ID) || (!recipient && transfer.FromUserID != user.ID) {
+		return nil, notFoundError("transfer_not_found")
+	}
+	switch transfer.Status {
+	case transferStatusPending:
+		return transfer, nil
+	case transferStatusExpired:
+		return nil, conflictError("transfer_expired")
+	}
+	return nil, conflictError("transfer_not_pending")
+}
+
+// respondTransfer moves a pending transfer to status and returns it reloaded.
+func respondTransfer(tx *sql.Tx, transfer *TicketTransfer, status string) (*TicketTransfer, error) {
+	if _, err := tx.Exec("UPDATE ticket_transfers SET status = ?, responded_at = ? WHERE id = ?", status, time.Now().UTC(), transfer.ID); err != nil {
+		return nil, err
+	}
+	return getTransfer(tx, transfer.ID)
+}
+
+// acceptTransferHandler makes the recipient the owner of the reservation. The
+// reservation must still belong to the sender; tickets issued to the sender
+// stop working because tokens carry the owner.
+func acceptTransferHandler(c echo.Context) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	transfer, err := lockPendingTransfer(c, tx, true)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var ownerID int64
+	var canceledAt *time.Time
+	var closed bool
+	if err := tx.QueryRow("SELECT r.user_id, r.canceled_at, e.closed_fg FROM reservations r INNER JOIN events e ON e.id = r.event_id WHERE r.id = ? FOR UPDATE", transfer.ReservationID).Scan(&ownerID, &canceledAt, &closed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if canceledAt != nil || ownerID != transfer.FromUserID {
+		tx.Rollback()
+		return conflictError("transfer_stale")
+	}
+	if err := checkTransferable(tx, transfer.EventID, transfer.ReservationID, closed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := checkPurchaseLimits(tx, transfer.ToUserID, transfer.EventID, transfer.SheetRank); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE reservations SET user_id = ? WHERE id = ?", transfer.ToUserID, transfer.ReservationID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	accepted, err := respondTransfer(tx, transfer, transferStatusAccepted)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "reservation.transfer", "reservation", transfer.ReservationID,
+		echo.Map{"user_id": transfer.FromUserID},
+		echo.Map{"user_id": transfer.ToUserID, "transfer_id": transfer.ID}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueNotification(tx, transfer.FromUserID, notificationTransferAccepted, map[string]interface{}{
+		"Title": transfer.Title, "SheetRank": transfer.SheetRank, "SheetNum": transfer.SheetNum, "To": transfer.ToNickname,
+	}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := enqueueWebhookEvent(tx, webhookReservationTransferred, echo.Map{"reservation_id": transfer.ReservationID, "event_id": transfer.EventID, "from_user_id": transfer.FromUserID, "to_user_id": transfer.ToUserID, "sheet_rank": transfer.SheetRank, "sheet_num": transfer.SheetNum}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, accepted)
+}
+
+// closeTransferHandler declines (by the recipient) or cancels (by the sender)
+// a pending transfer.
+func closeTransferHandler(status string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		transfer, err := lockPendingTransfer(c, tx, status == transferStatusDeclined)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		closed, err := respondTransfer(tx, transfer, status)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := writeAuditLog(tx, c, "transfer."+status, "reservation", transfer.ReservationID, echo.Map{"status": transferStatusPending}, echo.Map{"status": status, "transfer_id": transfer.ID}); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return c.JSON(200, closed)
+	}
+}
+
+// editTransferPolicyHandler enables or disables transfers of an event. Pending
+// transfers of a disabled event can no longer be accepted.
+func editTransferPolicyHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("not_found")
+	}
+	var params struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM events WHERE id = ? FOR UPDATE", eventID).Scan(&id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	before, err := getTransferPolicy(tx, eventID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO event_transfer_policies (event_id, enabled) VALUES (?, ?) ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)", eventID, params.Enabled); err != nil {
+		tx.Rollback()
+		return err
+	}
+	after := &TransferPolicy{Enabled: params.Enabled}
+	if err := writeAuditLog(tx, c, "event.edit_transfer_policy", "event", eventID, before, after); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, after)
+}
+
+type transferHistory struct {
+	OriginalUserID int64
+	TransferredAt  time.Time
+}
+
+// getTransferHistory returns, per transferred reservation, the user who bought
+// it and when it last changed hands. eventID 0 means all events.
+func getTransferHistory(eventID int64) (map[int64]*transferHistory, error) {
+	query := "SELECT reservation_id, from_user_id, responded_at FROM ticket_transfers WHERE status = ?"
+	args := []interface{}{transferStatusAccepted}
+	if eventID != 0 {
+		query += " AND event_id = ?"
+		args = append(args, eventID)
+	}
+	rows, err := db.Query(query+" ORDER BY responded_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := map[int64]*transferHistory{}
+	for rows.Next() {
+		var reservationID, fromUserID int64
+		var respondedAt time.Time
+		if err := rows.Scan(&reservationID, &fromUserID, &respondedAt); err != nil {
+			return nil, err
+		}
+		if h, ok := history[reservationID]; ok {
+			h.TransferredAt = respondedAt
+			continue
+		}
+		history[reservationID] = &transferHistory{OriginalUserID: fromUserID, TransferredAt: respondedAt}
+	}
+	return history, rows.Err()
+}
+
+// applyTransferHistory fills in the user who bought each reservation and the
+// time of the last transfer. user_id stays the user holding the reservation.
+func applyTransferHistory(reports []Report, eventID int64) error {
+	history, err := getTransferHistory(eventID)
+	if err != nil {
+		return err
+	}
+	for i := range reports {
+		report := &reports[i]
+		report.PurchaserUserID = report.UserID
+		if h, ok := history[report.ReservationID]; ok {
+			report.PurchaserUserID = h.OriginalUserID
+			report.TransferredAt = h.TransferredAt.Format("2006-01-02T15:04:05.000000Z")
+		}
+	}
+	return nil
+}
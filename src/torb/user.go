@@ -13,6 +13,9 @@ type User struct {
 	Nickname  string `json:"nickname,omitempty"`
 	LoginName string `json:"login_name,omitempty"`
 	PassHash  string `json:"pass_hash,omitempty"`
+	Email     string `json:"email,omitempty"`
+
+	SessionVersion int64 `json:"-"`
 }
 
 func sessUserID(c echo.Context) int64 {
@@ -24,7 +27,9 @@ func sessUserID(c echo.Context) int64 {
 	return userID
 }
 
-func sessSetUserID(c echo.Context, id int64) {
+// sessSetUserID also remembers the session version of the user, so that bumping
+// users.session_version revokes every session issued before.
+func sessSetUserID(c echo.Context, id, sessionVersion int64) {
 	sess, _ := session.Get("session", c)
 	sess.Options = &sessions.Options{
 		Path:     "/",
@@ -32,9 +37,19 @@ func sessSetUserID(c echo.Context, id int64) {
 		HttpOnly: true,
 	}
 	sess.Values["user_id"] = id
+	sess.Values["user_session_version"] = sessionVersion
 	sess.Save(c.Request(), c.Response())
 }
 
+func sessUserSessionVersion(c echo.Context) int64 {
+	sess, _ := session.Get("session", c)
+	var sessionVersion int64
+	if x, ok := sess.Values["user_session_version"]; ok {
+		sessionVersion, _ = x.(int64)
+	}
+	return sessionVersion
+}
+
 func sessDeleteUserID(c echo.Context) {
 	sess, _ := session.Get("session", c)
 	sess.Options = &sessions.Options{
@@ -43,6 +58,7 @@ func sessDeleteUserID(c echo.Context) {
 		HttpOnly: true,
 	}
 	delete(sess.Values, "user_id")
+	delete(sess.Values, "user_session_version")
 	sess.Save(c.Request(), c.Response())
 }
 
@@ -52,8 +68,14 @@ func getLoginUser(c echo.Context) (*User, error) {
 		return nil, errors.New("not logged in")
 	}
 	var user User
-	err := db.QueryRow("SELECT id, nickname FROM users WHERE id = ?", userID).Scan(&user.ID, &user.Nickname)
-	return &user, err
+	err := db.QueryRow("SELECT id, nickname, session_version FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&user.ID, &user.Nickname, &user.SessionVersion)
+	if err != nil {
+		return nil, err
+	}
+	if user.SessionVersion != sessUserSessionVersion(c) {
+		return nil, errors.New("session revoked")
+	}
+	return &user, nil
 }
 
 func fillinUser(next echo.HandlerFunc) echo.HandlerFunc {
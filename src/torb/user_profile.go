@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const deletedUserNickname = "退会済みユーザー"
+
+// profileOwner resolves :id and makes sure it is the logged in user.
+func profileOwner(c echo.Context) (*User, bool, error) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, false, notFoundError("not_found")
+	}
+	loginUser, err := getLoginUser(c)
+	if err != nil {
+		return nil, false, err
+	}
+	if loginUser.ID != userID {
+		return nil, false, forbiddenError("forbidden")
+	}
+	return loginUser, true, nil
+}
+
+func validateEmail(email string) bool {
+	if len(email) > 255 {
+		return false
+	}
+	at := strings.Index(email, "@")
+	return at > 0 && at == strings.LastIndex(email, "@") && at < len(email)-1 && !strings.ContainsAny(email, " \t\r\n")
+}
+
+// verifyUserPassword re-authenticates the user for sensitive operations. Attempts
+// go through the same login guard as the login, so a stolen session cannot be
+// used to guess the password.
+func verifyUserPassword(c echo.Context, userID int64, password string) error {
+	var loginName string
+	var matched bool
+	if err := db.QueryRow("SELECT login_name, pass_hash = SHA2(?, 256) FROM users WHERE id = ? AND deleted_at IS NULL", password, userID).Scan(&loginName, &matched); err != nil {
+		if err == sql.ErrNoRows {
+			return unauthorizedError("authentication_failed")
+		}
+		return err
+	}
+	if ok, err := checkLogin(c, loginScopeUser, loginName); !ok {
+		return err
+	}
+	if !matched {
+		return resLoginFailed(c, loginScopeUser, loginName)
+	}
+	return recordLoginSuccess(c, loginScopeUser, loginName)
+}
+
+var errEmailTaken = &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: []FieldError{{Field: "email", Code: "email_taken", Message: "is already used by another user"}}}
+
+func editUserHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	var params struct {
+		Nickname *string `json:"nickname" validate:"max=128,charset=printable"`
+		Email    *string `json:"email" validate:"max=255,email"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	var before User
+	var beforeEmail sql.NullString
+	if err := db.QueryRow("SELECT nickname, email FROM users WHERE id = ?", loginUser.ID).Scan(&before.Nickname, &beforeEmail); err != nil {
+		return err
+	}
+	before.Email = beforeEmail.String
+	after := before
+
+	if params.Nickname != nil {
+		if *params.Nickname == "" {
+			return validationError("invalid_nickname")
+		}
+		after.Nickname = *params.Nickname
+	}
+	if params.Email != nil {
+		after.Email = *params.Email
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if after.Email != "" && after.Email != before.Email {
+		var id int64
+		if err := tx.QueryRow("SELECT id FROM users WHERE email = ?", after.Email).Scan(&id); err != sql.ErrNoRows {
+			tx.Rollback()
+			if err == nil {
+				return errEmailTaken
+			}
+			return err
+		}
+	}
+	email := sql.NullString{String: after.Email, Valid: after.Email != ""}
+	if _, err := tx.Exec("UPDATE users SET nickname = ?, email = ? WHERE id = ?", after.Nickname, email, loginUser.ID); err != nil {
+		tx.Rollback()
+		// 同時に同じアドレスへ変更された場合は一意キーで弾かれる
+		if isDuplicateKeyError(err) {
+			return errEmailTaken
+		}
+		return err
+	}
+	if err := writeAuditLog(tx, c, "user.edit", "user", loginUser.ID,
+		echo.Map{"nickname": before.Nickname, "email": before.Email},
+		echo.Map{"nickname": after.Nickname, "email": after.Email}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(200, echo.Map{
+		"id":       loginUser.ID,
+		"nickname": after.Nickname,
+		"email":    after.Email,
+	})
+}
+
+// changeUserPasswordHandler requires the current password. Other sessions of the
+// user are revoked while the current one is kept logged in.
+func changeUserPasswordHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	var params struct {
+		CurrentPassword string `json:"current_password" validate:"required,max=128"`
+		NewPassword     string `json:"new_password" validate:"required,max=128"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	if err := verifyUserPassword(c, loginUser.ID, params.CurrentPassword); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET pass_hash = SHA2(?, 256), session_version = session_version + 1 WHERE id = ?", params.NewPassword, loginUser.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var sessionVersion int64
+	if err := tx.QueryRow("SELECT session_version FROM users WHERE id = ?", loginUser.ID).Scan(&sessionVersion); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "user.change_password", "user", loginUser.ID, nil, echo.Map{"sessions_revoked": true}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sessSetUserID(c, loginUser.ID, sessionVersion)
+	return c.NoContent(204)
+}
+
+// deleteUserHandler cancels the user's reservations for open events that have
+// not been used and scrubs the personal data from the users row. Reservations of
+// closed events and checked-in tickets are history and stay as they are. The
+// row itself is kept so that reservations and sales reports keep pointing at a
+// valid, anonymous user.
+func deleteUserHandler(c echo.Context) error {
+	loginUser, ok, err := profileOwner(c)
+	if !ok {
+		return err
+	}
+	var params struct {
+		Password string `json:"password" validate:"required,max=128"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+
+	if err := verifyUserPassword(c, loginUser.ID, params.Password); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT r.id, r.event_id, r.sheet_id, r.user_id, e.title FROM reservations r INNER JOIN events e ON e.id = r.event_id"+
+		" WHERE r.user_id = ? AND r.canceled_at IS NULL AND e.closed_fg = 0 AND NOT EXISTS (SELECT 1 FROM checkins ci WHERE ci.reservation_id = r.id) FOR UPDATE", loginUser.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var reservations []Reservation
+	var events []Event
+	for rows.Next() {
+		var reservation Reservation
+		var event Event
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &event.Title); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		event.ID = reservation.EventID
+		reservations = append(reservations, reservation)
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range reservations {
+		sheet, _ := getSheetByID(reservations[i].SheetID)
+		if sheet == nil {
+			tx.Rollback()
+			return notFoundError("invalid_sheet")
+		}
+		if err := cancelReservation(tx, c, &reservations[i], &events[i], sheet); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// 残った予約（終了済みイベント・入場済み）の出品と、受け取り待ちの譲渡、未発表の抽選の申込も閉じる
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	if _, err := tx.Exec("UPDATE resale_listings SET status = ?, closed_at = ? WHERE seller_user_id = ? AND status = ?", resaleStatusWithdrawn, now, loginUser.ID, resaleStatusActive); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE ticket_transfers SET status = ?, responded_at = ? WHERE (from_user_id = ? OR to_user_id = ?) AND status = ?", transferStatusCanceled, now, loginUser.ID, loginUser.ID, transferStatusPending); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE lottery_entries le INNER JOIN event_lotteries l ON l.event_id = le.event_id SET le.canceled_at = ? WHERE le.user_id = ? AND le.canceled_at IS NULL AND l.status <> ?",
+		now, loginUser.ID, lotteryStatusPublished); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET login_name = ?, nickname = ?, pass_hash = '', email = NULL, session_version = session_version + 1, deleted_at = ? WHERE id = ?",
+		"deleted:"+strconv.FormatInt(loginUser.ID, 10), deletedUserNickname, now, loginUser.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "user.delete", "user", loginUser.ID, nil, echo.Map{"canceled_reservations": len(reservations)}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sessDeleteUserID(c)
+	return c.NoContent(204)
+}
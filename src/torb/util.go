@@ -1,5 +1,13 @@
 package main
 
+import "github.com/go-sql-driver/mysql"
+
+// isDuplicateKeyError reports whether err is a violation of a unique key.
+func isDuplicateKeyError(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && merr.Number == 1062
+}
+
 func contains(ids []int64, id int64) bool {
 	for k := range ids {
 		if ids[k] == id {
@@ -8,3 +16,12 @@ func contains(ids []int64, id int64) bool {
 	}
 	return false
 }
+
+func containsString(values []string, value string) bool {
+	for k := range values {
+		if values[k] == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// structValidator validates request structs by their `validate` tags. Rules are
+// separated by commas:
+//
+//	required     the field must be present and non-empty (pointers: non-nil)
+//	min=N,max=N  rune length for strings, value for integers
+//	charset=X    one of loginname, printable, digits
+//	oneof=A|B    the value must be one of the listed strings
+//	email        a plausible e-mail address
+//
+// Optional fields (no required rule) are only checked when they are non-empty.
+type structValidator struct{}
+
+func (structValidator) Validate(i interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(i))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Type()
+
+	var fields []FieldError
+	for n := 0; n < t.NumField(); n++ {
+		sf := t.Field(n)
+		tag := sf.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = sf.Name
+		}
+		if fe := validateField(name, v.Field(n), strings.Split(tag, ",")); fe != nil {
+			fields = append(fields, *fe)
+		}
+	}
+	if fields != nil {
+		return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+	return nil
+}
+
+func validateField(name string, fv reflect.Value, rules []string) *FieldError {
+	required := false
+	for _, rule := range rules {
+		if rule == "required" {
+			required = true
+		}
+	}
+
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			if required {
+				return &FieldError{Field: name, Code: "required", Message: "is required"}
+			}
+			return nil
+		}
+		fv = fv.Elem()
+	}
+	if fv.Kind() == reflect.String && fv.Len() == 0 {
+		if required {
+			return &FieldError{Field: name, Code: "required", Message: "is required"}
+		}
+		return nil
+	}
+
+	for _, rule := range rules {
+		key, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			key, arg = rule[:i], rule[i+1:]
+		}
+		switch key {
+		case "min", "max":
+			limit, _ := strconv.ParseInt(arg, 10, 64)
+			var value int64
+			var unit string
+			switch fv.Kind() {
+			case reflect.String:
+				value, unit = int64(utf8.RuneCountInString(fv.String())), " characters"
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				value = fv.Int()
+			default:
+				continue
+			}
+			if key == "min" && value < limit {
+				return &FieldError{Field: name, Code: "too_small", Message: fmt.Sprintf("must be at least %d%s", limit, unit)}
+			}
+			if key == "max" && value > limit {
+				return &FieldError{Field: name, Code: "too_large", Message: fmt.Sprintf("must be at most %d%s", limit, unit)}
+			}
+		case "charset":
+			if !matchCharset(fv.String(), arg) {
+				return &FieldError{Field: name, Code: "invalid_charset", Message: "contains characters not allowed (" + arg + ")"}
+			}
+		case "oneof":
+			if !containsString(strings.Split(arg, "|"), fv.String()) {
+				return &FieldError{Field: name, Code: "invalid_choice", Message: "must be one of " + strings.Replace(arg, "|", ", ", -1)}
+			}
+		case "email":
+			if !validateEmail(fv.String()) {
+				return &FieldError{Field: name, Code: "invalid_format", Message: "must be a valid e-mail address"}
+			}
+		}
+	}
+	return nil
+}
+
+func matchCharset(s, charset string) bool {
+	for _, r := range s {
+		switch charset {
+		case "loginname":
+			if !(r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.')) {
+				return false
+			}
+		case "digits":
+			if !(r >= '0' && r <= '9') {
+				return false
+			}
+		case "printable":
+			if !unicode.IsPrint(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bindParams binds the request into params and validates it. An empty body is
+// treated like an empty object so that missing fields are reported per field.
+// Failures are returned as a validation DomainError with per-field details.
+func bindParams(c echo.Context, params interface{}) error {
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(params); err != nil {
+			return &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: []FieldError{{Field: "", Code: "malformed", Message: "request body is malformed"}}}
+		}
+	}
+	return c.Validate(params)
+}
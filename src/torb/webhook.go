@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	webhookReservationCreated     = "reservation.created"
+	webhookReservationCanceled    = "reservation.canceled"
+	webhookReservationTransferred = "reservation.transferred"
+	webhookReservationResold      = "reservation.resold"
+	webhookReservationSeatChanged = "reservation.seat_changed"
+	webhookEventOpened            = "event.opened"
+	webhookEventUnpublished       = "event.unpublished"
+	webhookEventClosed            = "event.closed"
+
+	webhookStatusPending   = "pending"
+	webhookStatusDelivered = "delivered"
+	webhookStatusFailed    = "failed"
+
+	webhookMaxAttempts = 10
+	webhookBatchSize   = 20
+	webhookLease       = 5 * time.Minute
+
+	webhookSignatureHeader = "X-Torb-Signature"
+)
+
+var webhookEventTypes = []string{
+	webhookReservationCreated,
+	webhookReservationCanceled,
+	webhookReservationTransferred,
+	webhookReservationResold,
+	webhookReservationSeatChanged,
+	webhookEventOpened,
+	webhookEventUnpublished,
+	webhookEventClosed,
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookSubscription receives the events it lists ("*" for all). The secret
+// is only returned when the subscription is created or the secret is rotated.
+type WebhookSubscription struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	SubscriptionID int64      `json:"subscription_id"`
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	RedeliveryOf   *int64     `json:"redelivery_of,omitempty"`
+	CreatedAt      time.Time  `json:"-"`
+	NextAttemptAt  time.Time  `json:"-"`
+	DeliveredAt    *time.Time `json:"-"`
+
+	CreatedAtUnix     int64 `json:"created_at"`
+	NextAttemptAtUnix int64 `json:"next_attempt_at,omitempty"`
+	DeliveredAtUnix   int64 `json:"delivered_at,omitempty"`
+}
+
+// signWebhookPayload returns the X-Torb-Signature value for body:
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">". Receivers
+// should recompute it with their secret and reject stale timestamps.
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	t := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// enqueueWebhookEvent queues one delivery per active subscription listening to
+// eventType. Call it inside the transaction of the change it reports.
+func enqueueWebhookEvent(q notificationDB, eventType string, data interface{}) error {
+	rows, err := q.Query("SELECT id, events FROM webhook_subscriptions WHERE active = 1")
+	if err != nil {
+		return err
+	}
+	var subscriptionIDs []int64
+	for rows.Next() {
+		var id int64
+		var events string
+		if err := rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, ev := range strings.Split(events, ",") {
+			if ev == "*" || ev == eventType {
+				subscriptionIDs = append(subscriptionIDs, id)
+				break
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(subscriptionIDs) == 0 {
+		return nil
+	}
+
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	eventID := "evt_" + hex.EncodeToString(b)
+	now := time.Now().UTC()
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":         eventID,
+		"type":       eventType,
+		"created_at": now.Unix(),
+		"data":       data,
+	})
+	if err != nil {
+		return err
+	}
+	for _, subscriptionID := range subscriptionIDs {
+		if _, err := q.Exec("INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload, status, attempts, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, 0, ?, ?)",
+			subscriptionID, eventID, eventType, payload, webhookStatusPending, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runWebhookWorker delivers due webhooks every interval. Rows are claimed the
+// same way as in the notification worker, so several instances may run it.
+func runWebhookWorker(interval time.Duration) {
+	for {
+		if err := deliverWebhooks(time.Now().UTC()); err != nil {
+			log.Println("webhook worker:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func deliverWebhooks(now time.Time) error {
+	rows, err := db.Query("SELECT id, attempts FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?", webhookStatusPending, now, webhookBatchSize)
+	if err != nil {
+		return err
+	}
+	type candidate struct {
+		id       int64
+		attempts int
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var cand candidate
+		if err := rows.Scan(&cand.id, &cand.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		candidates = append(candidates, cand)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, cand := range candidates {
+		res, err := db.Exec("UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = ? WHERE id = ? AND status = ? AND attempts = ?",
+			now.Add(webhookLease), cand.id, webhookStatusPending, cand.attempts)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			continue
+		}
+		if err := deliverWebhook(cand.id, cand.attempts+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverWebhook posts a claimed delivery and records the outcome. Any 2xx
+// response counts as delivered.
+func deliverWebhook(id int64, attempts int) error {
+	var subscriptionURL, secret, eventID, eventType string
+	var active bool
+	var payload []byte
+	err := db.QueryRow("SELECT s.url, s.secret, s.active, d.event_id, d.event_type, d.payload FROM webhook_deliveries d INNER JOIN webhook_subscriptions s ON s.id = d.subscription_id WHERE d.id = ?", id).
+		Scan(&subscriptionURL, &secret, &active, &eventID, &eventType, &payload)
+	if err == sql.ErrNoRows {
+		_, err = db.Exec("UPDATE webhook_deliveries SET status = ?, last_error = ? WHERE id = ?", webhookStatusFailed, "subscription_deleted", id)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if !active {
+		_, err = db.Exec("UPDATE webhook_deliveries SET status = ?, last_error = ? WHERE id = ?", webhookStatusFailed, "subscription_inactive", id)
+		return err
+	}
+
+	statusCode, sendErr := postWebhook(subscriptionURL, secret, eventID, eventType, payload)
+	now := time.Now().UTC()
+	if sendErr == nil {
+		_, err := db.Exec("UPDATE webhook_deliveries SET status = ?, last_status_code = ?, last_error = '', delivered_at = ? WHERE id = ?", webhookStatusDelivered, statusCode, now, id)
+		return err
+	}
+
+	log.Printf("webhook delivery id=%d event=%s attempt=%d: %v", id, eventType, attempts, sendErr)
+	lastError := sendErr.Error()
+	if len(lastError) > 255 {
+		lastError = lastError[:255]
+	}
+	status := webhookStatusPending
+	if attempts >= webhookMaxAttempts {
+		status = webhookStatusFailed
+	}
+	_, err = db.Exec("UPDATE webhook_deliveries SET status = ?, next_attempt_at = ?, last_status_code = ?, last_error = ? WHERE id = ?",
+		status, now.Add(retryBackoff(attempts)), statusCode, lastError, id)
+	return err
+}
+
+func postWebhook(subscriptionURL, secret, eventID, eventType string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", subscriptionURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Torb-Webhook/1.0")
+	req.Header.Set("X-Torb-Event", eventType)
+	req.Header.Set("X-Torb-Event-Id", eventID)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(secret, time.Now().Unix(), payload))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode/100 != 2 {
+		return res.StatusCode, fmt.Errorf("responded %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+type webhookSubscriptionParams struct {
+	URL    string   `json:"url" validate:"required,max=512,charset=printable"`
+	Events []string `json:"events"`
+}
+
+// validate checks the URL scheme and the event list and returns the events
+// normalized for storage.
+func (p *webhookSubscriptionParams) validate() (string, error) {
+	var fields []FieldError
+	if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fields = append(fields, FieldError{Field: "url", Code: "invalid_url", Message: "must be an http or https URL"})
+	}
+	events := []string{}
+	for i, ev := range p.Events {
+		if ev != "*" && !containsString(webhookEventTypes, ev) {
+			fields = append(fields, FieldError{Field: "events[" + strconv.Itoa(i) + "]", Code: "invalid_choice", Message: "must be * or one of " + strings.Join(webhookEventTypes, ", ")})
+			continue
+		}
+		if !containsString(events, ev) {
+			events = append(events, ev)
+		}
+	}
+	if len(p.Events) == 0 {
+		fields = append(fields, FieldError{Field: "events", Code: "required", Message: "is required"})
+	}
+	if fields != nil {
+		return "", &DomainError{Kind: KindValidation, Code: "validation_failed", Fields: fields}
+	}
+	sort.Strings(events)
+	return strings.Join(events, ","), nil
+}
+
+func getWebhookSubscription(q queryRower, id int64) (*WebhookSubscription, error) {
+	var s WebhookSubscription
+	var events string
+	err := q.QueryRow("SELECT id, url, events, active, created_at FROM webhook_subscriptions WHERE id = ?", id).Scan(&s.ID, &s.URL, &events, &s.Active, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("webhook_not_found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Events = strings.Split(events, ",")
+	s.CreatedAtUnix = s.CreatedAt.Unix()
+	return &s, nil
+}
+
+func webhookIDParam(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, notFoundError("webhook_not_found")
+	}
+	return id, nil
+}
+
+func getWebhooksHandler(c echo.Context) error {
+	rows, err := db.Query("SELECT id, url, events, active, created_at FROM webhook_subscriptions ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	subscriptions := []*WebhookSubscription{}
+	for rows.Next() {
+		var s WebhookSubscription
+		var events string
+		if err := rows.Scan(&s.ID, &s.URL, &events, &s.Active, &s.CreatedAt); err != nil {
+			return err
+		}
+		s.Events = strings.Split(events, ",")
+		s.CreatedAtUnix = s.CreatedAt.Unix()
+		subscriptions = append(subscriptions, &s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, subscriptions)
+}
+
+func postWebhooksHandler(c echo.Context) error {
+	var params webhookSubscriptionParams
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	events, err := params.validate()
+	if err != nil {
+		return err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO webhook_subscriptions (url, secret, events, active, created_at) VALUES (?, ?, ?, 1, ?)", params.URL, secret, events, time.Now().UTC())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	subscription, err := getWebhookSubscription(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "webhook.create", "webhook", id, nil, subscription); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	subscription.Secret = secret
+	return c.JSON(201, subscription)
+}
+
+func editWebhookHandler(c echo.Context) error {
+	id, err := webhookIDParam(c)
+	if err != nil {
+		return err
+	}
+	var params struct {
+		URL    string   `json:"url" validate:"required,max=512,charset=printable"`
+		Events []string `json:"events"`
+		Active bool     `json:"active"`
+	}
+	if err := bindParams(c, &params); err != nil {
+		return err
+	}
+	events, err := (&webhookSubscriptionParams{URL: params.URL, Events: params.Events}).validate()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	before, err := getWebhookSubscription(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE webhook_subscriptions SET url = ?, events = ?, active = ? WHERE id = ?", params.URL, events, params.Active, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	subscription, err := getWebhookSubscription(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "webhook.edit", "webhook", id, before, subscription); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(200, subscription)
+}
+
+// rotateWebhookSecretHandler replaces the secret. Deliveries still in the
+// queue are signed with the new secret when they are sent.
+func rotateWebhookSecretHandler(c echo.Context) error {
+	id, err := webhookIDParam(c)
+	if err != nil {
+		return err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	subscription, err := getWebhookSubscription(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE webhook_subscriptions SET secret = ? WHERE id = ?", secret, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "webhook.rotate_secret", "webhook", id, nil, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	subscription.Secret = secret
+	return c.JSON(200, subscription)
+}
+
+// deleteWebhookHandler removes the subscription. Its delivery log is kept;
+// pending deliveries fail with subscription_deleted.
+func deleteWebhookHandler(c echo.Context) error {
+	id, err := webhookIDParam(c)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	before, err := getWebhookSubscription(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_subscriptions WHERE id = ?", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "webhook.delete", "webhook", id, before, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
+
+// getWebhookDeliveriesHandler returns the delivery log of a subscription,
+// newest first. Filters: status, event_type.
+func getWebhookDeliveriesHandler(c echo.Context) error {
+	id, err := webhookIDParam(c)
+	if err != nil {
+		return err
+	}
+	query := "SELECT id, subscription_id, event_id, event_type, status, attempts, last_status_code, last_error, redelivery_of, created_at, next_attempt_at, delivered_at FROM webhook_deliveries WHERE subscription_id = ?"
+	args := []interface{}{id}
+	if v := c.QueryParam("status"); v != "" {
+		query += " AND status = ?"
+		args = append(args, v)
+	}
+	if v := c.QueryParam("event_type"); v != "" {
+		query += " AND event_type = ?"
+		args = append(args, v)
+	}
+	query += " ORDER BY id DESC LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError, &d.RedeliveryOf, &d.CreatedAt, &d.NextAttemptAt, &d.DeliveredAt); err != nil {
+			return err
+		}
+		d.CreatedAtUnix = d.CreatedAt.Unix()
+		if d.Status == webhookStatusPending {
+			d.NextAttemptAtUnix = d.NextAttemptAt.Unix()
+		}
+		if d.DeliveredAt != nil {
+			d.DeliveredAtUnix = d.DeliveredAt.Unix()
+		}
+		deliveries = append(deliveries, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, deliveries)
+}
+
+// redeliverWebhookHandler queues the payload of a past delivery again as a new
+// delivery so that the log of the original stays intact. The event id is the
+// same, which lets receivers deduplicate.
+func redeliverWebhookHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return notFoundError("webhook_delivery_not_found")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var subscriptionID int64
+	var eventID, eventType, status string
+	var payload []byte
+	if err := tx.QueryRow("SELECT subscription_id, event_id, event_type, payload, status FROM webhook_deliveries WHERE id = ?", id).Scan(&subscriptionID, &eventID, &eventType, &payload, &status); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return notFoundError("webhook_delivery_not_found")
+		}
+		return err
+	}
+	if status == webhookStatusPending {
+		tx.Rollback()
+		return conflictError("webhook_delivery_pending")
+	}
+	if _, err := getWebhookSubscription(tx, subscriptionID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload, status, attempts, next_attempt_at, redelivery_of, created_at) VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?)",
+		subscriptionID, eventID, eventType, payload, webhookStatusPending, now, id, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := writeAuditLog(tx, c, "webhook.redeliver", "webhook", subscriptionID, nil, echo.Map{"delivery_id": newID, "redelivery_of": id, "event_id": eventID}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return c.JSON(202, echo.Map{"id": newID, "redelivery_of": id})
+}